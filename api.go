@@ -0,0 +1,700 @@
+package main
+
+import (
+	"database/sql"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// openAPISpec describes the /api/v1 endpoints
+//
+//go:embed api/openapi.json
+var openAPISpec []byte
+
+// maxAPIBodySize limits the size of JSON request bodies
+const maxAPIBodySize = 1 << 20
+
+// APIError is the body of every failed /api/v1 response
+type APIError struct {
+	Error APIErrorDetail `json:"error"`
+}
+
+// APIErrorDetail holds a stable machine-readable code and a human-readable message
+type APIErrorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// AskResult is the answer to a question about a project
+type AskResult struct {
+	Project   string   `json:"project"`
+	SessionID string   `json:"session_id"` // Pass back to ask a follow-up question
+	Query     string   `json:"query"`
+	Answer    string   `json:"answer"`
+	Sources   []Source `json:"sources"`
+}
+
+// ReviewResult is the review of a single commit
+type ReviewResult struct {
+	Project string `json:"project"`
+	Commit  string `json:"commit"`
+	Review  string `json:"review"`
+}
+
+// ProjectStats summarizes what has been indexed for a project
+type ProjectStats struct {
+	DocFiles       int `json:"doc_files"`
+	TrackedFiles   int `json:"tracked_files"`
+	VectorDocCount int `json:"vector_documents"`
+}
+
+// ProjectDetails is a project's config together with its stats and latest job
+type ProjectDetails struct {
+	ProjectConfig
+	Stats     ProjectStats `json:"stats"`
+	LatestJob *JobSnapshot `json:"latest_job,omitempty"`
+}
+
+// ProjectRequest is the body for creating or updating a project. On update
+// only the fields that are present are changed.
+type ProjectRequest struct {
+	Name           string           `json:"name"`
+	Path           *string          `json:"path"`
+	ExcludeFolders *[]string        `json:"exclude_folders"`
+	ExcludeFiles   *[]string        `json:"exclude_files"`
+	Retrieval      *RetrievalConfig `json:"retrieval"`
+	Index          *bool            `json:"index"` // Start indexing after creating, defaults to true
+}
+
+// registerAPIRoutes adds the /api/v1 endpoints to mux.
+func (ca *CodeAssistant) registerAPIRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/v1/openapi.json", ca.apiOpenAPI)
+	mux.HandleFunc("GET /api/v1/projects", ca.apiListProjects)
+	mux.HandleFunc("POST /api/v1/projects", ca.apiCreateProject)
+	mux.HandleFunc("GET /api/v1/projects/{name}", ca.apiGetProject)
+	mux.HandleFunc("PATCH /api/v1/projects/{name}", ca.apiUpdateProject)
+	mux.HandleFunc("DELETE /api/v1/projects/{name}", ca.apiDeleteProject)
+	mux.HandleFunc("POST /api/v1/projects/{name}/index", ca.apiIndexProject)
+	mux.HandleFunc("POST /api/v1/projects/{name}/reindex", ca.apiReindexProject)
+	mux.HandleFunc("GET /api/v1/projects/{name}/failed-files", ca.apiListFailedFiles)
+	mux.HandleFunc("POST /api/v1/projects/{name}/retry-failed", ca.apiRetryFailed)
+	mux.HandleFunc("POST /api/v1/projects/{name}/ask", ca.apiAsk)
+	mux.HandleFunc("GET /api/v1/projects/{name}/sessions", ca.apiListChatSessions)
+	mux.HandleFunc("GET /api/v1/sessions/{id}", ca.apiGetChatSession)
+	mux.HandleFunc("DELETE /api/v1/sessions/{id}", ca.apiDeleteChatSession)
+	mux.HandleFunc("GET /api/v1/projects/{name}/commits", ca.apiListCommits)
+	mux.HandleFunc("POST /api/v1/projects/{name}/reviews", ca.apiReviewCommit)
+	mux.HandleFunc("GET /api/v1/projects/{name}/members", ca.apiListMembers)
+	mux.HandleFunc("PUT /api/v1/projects/{name}/members/{username}", ca.apiSetMember)
+	mux.HandleFunc("DELETE /api/v1/projects/{name}/members/{username}", ca.apiRemoveMember)
+	mux.HandleFunc("GET /api/v1/users", ca.apiListUsers)
+	mux.HandleFunc("POST /api/v1/users", ca.apiCreateUser)
+	mux.HandleFunc("DELETE /api/v1/users/{username}", ca.apiDeleteUser)
+	mux.HandleFunc("GET /api/v1/jobs", ca.apiListJobs)
+	mux.HandleFunc("GET /api/v1/jobs/{id}", ca.apiGetJob)
+	mux.HandleFunc("GET /api/v1/models", ca.apiListModels)
+	mux.HandleFunc("/api/v1/", func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, http.StatusNotFound, "not_found", "unknown API endpoint")
+	})
+}
+
+// writeAPIJSON writes v as a JSON response with the given status code.
+func writeAPIJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	writeJSON(w, v)
+}
+
+// writeAPIError writes an error in the consistent APIError shape.
+func writeAPIError(w http.ResponseWriter, status int, code, message string) {
+	writeAPIJSON(w, status, APIError{Error: APIErrorDetail{Code: code, Message: message}})
+}
+
+// decodeAPIBody decodes a JSON request body into v, writing an error response on failure.
+func decodeAPIBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	r.Body = http.MaxBytesReader(w, r.Body, maxAPIBodySize)
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_body", fmt.Sprintf("invalid JSON body: %v", err))
+		return false
+	}
+	return true
+}
+
+// apiProject loads the project named in the URL, writing an error response
+// when the caller lacks role on it or it does not exist.
+func (ca *CodeAssistant) apiProject(w http.ResponseWriter, r *http.Request, role Role) (ProjectConfig, bool) {
+	name := r.PathValue("name")
+	if !validProjectName(name) {
+		writeAPIError(w, http.StatusBadRequest, "invalid_project", "invalid project name")
+		return ProjectConfig{}, false
+	}
+	if !ca.authorize(w, r, name, role) {
+		return ProjectConfig{}, false
+	}
+	projectConfig, err := ca.loadProjectConfig(name)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal", fmt.Sprintf("error loading project config: %v", err))
+		return ProjectConfig{}, false
+	}
+	if projectConfig.ProjectName == "" {
+		writeAPIError(w, http.StatusNotFound, "project_not_found", fmt.Sprintf("project %s not found", name))
+		return ProjectConfig{}, false
+	}
+	return projectConfig, true
+}
+
+func (ca *CodeAssistant) apiOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
+
+func (ca *CodeAssistant) apiListProjects(w http.ResponseWriter, r *http.Request) {
+	names, err := ca.listProjects(r.Context())
+	if err != nil && !os.IsNotExist(err) {
+		writeAPIError(w, http.StatusInternalServerError, "internal", fmt.Sprintf("error listing projects: %v", err))
+		return
+	}
+
+	projects := []ProjectConfig{}
+	for _, name := range names {
+		projectConfig, err := ca.loadProjectConfig(name)
+		if err != nil || projectConfig.ProjectName == "" {
+			continue
+		}
+		projects = append(projects, projectConfig)
+	}
+	writeAPIJSON(w, http.StatusOK, projects)
+}
+
+func (ca *CodeAssistant) apiCreateProject(w http.ResponseWriter, r *http.Request) {
+	var req ProjectRequest
+	if !decodeAPIBody(w, r, &req) {
+		return
+	}
+	if !validProjectName(req.Name) {
+		writeAPIError(w, http.StatusBadRequest, "invalid_project", "a valid project name is required")
+		return
+	}
+	if !ca.authorize(w, r, req.Name, RoleMaintainer) {
+		return
+	}
+	if req.Path == nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_path", "path is required")
+		return
+	}
+	if info, err := os.Stat(*req.Path); err != nil || !info.IsDir() {
+		writeAPIError(w, http.StatusBadRequest, "invalid_path", fmt.Sprintf("codebase path %q is not a readable directory", *req.Path))
+		return
+	}
+
+	existing, err := ca.loadProjectConfig(req.Name)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal", fmt.Sprintf("error loading project config: %v", err))
+		return
+	}
+	if existing.ProjectName != "" {
+		writeAPIError(w, http.StatusConflict, "project_exists", fmt.Sprintf("project %s already exists", req.Name))
+		return
+	}
+
+	projectConfig := ProjectConfig{
+		ProjectName:    req.Name,
+		ProjectPath:    *req.Path,
+		ExcludeFolders: []string{},
+		ExcludeFiles:   []string{},
+		LastUpdated:    time.Now(),
+	}
+	if req.ExcludeFolders != nil {
+		projectConfig.ExcludeFolders = *req.ExcludeFolders
+	}
+	if req.ExcludeFiles != nil {
+		projectConfig.ExcludeFiles = *req.ExcludeFiles
+	}
+	if req.Retrieval != nil {
+		projectConfig.Retrieval = *req.Retrieval
+	}
+	if err := ca.saveProjectConfig(projectConfig); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal", fmt.Sprintf("error saving project config: %v", err))
+		return
+	}
+
+	details := ProjectDetails{ProjectConfig: projectConfig}
+	if req.Index == nil || *req.Index {
+		job, err := ca.startIndexJob(projectConfig.ProjectName, projectConfig.ProjectPath, projectConfig.ExcludeFolders, projectConfig.ExcludeFiles)
+		if err != nil {
+			writeAPIError(w, http.StatusConflict, "project_busy", err.Error())
+			return
+		}
+		snapshot := job.Snapshot()
+		details.LatestJob = &snapshot
+	}
+	w.Header().Set("Location", "/api/v1/projects/"+projectConfig.ProjectName)
+	writeAPIJSON(w, http.StatusCreated, details)
+}
+
+func (ca *CodeAssistant) apiGetProject(w http.ResponseWriter, r *http.Request) {
+	projectConfig, ok := ca.apiProject(w, r, RoleViewer)
+	if !ok {
+		return
+	}
+
+	details := ProjectDetails{
+		ProjectConfig: projectConfig,
+		Stats:         ca.projectStats(projectConfig),
+	}
+	if job, ok := ca.jobs.Latest(projectConfig.ProjectName); ok {
+		snapshot := job.Snapshot()
+		details.LatestJob = &snapshot
+	}
+	writeAPIJSON(w, http.StatusOK, details)
+}
+
+func (ca *CodeAssistant) apiUpdateProject(w http.ResponseWriter, r *http.Request) {
+	projectConfig, ok := ca.apiProject(w, r, RoleMaintainer)
+	if !ok {
+		return
+	}
+	var req ProjectRequest
+	if !decodeAPIBody(w, r, &req) {
+		return
+	}
+	if req.Name != "" && req.Name != projectConfig.ProjectName {
+		writeAPIError(w, http.StatusBadRequest, "invalid_project", "projects cannot be renamed")
+		return
+	}
+
+	if req.Path != nil {
+		if info, err := os.Stat(*req.Path); err != nil || !info.IsDir() {
+			writeAPIError(w, http.StatusBadRequest, "invalid_path", fmt.Sprintf("codebase path %q is not a readable directory", *req.Path))
+			return
+		}
+		projectConfig.ProjectPath = *req.Path
+	}
+	if req.ExcludeFolders != nil {
+		projectConfig.ExcludeFolders = *req.ExcludeFolders
+	}
+	if req.ExcludeFiles != nil {
+		projectConfig.ExcludeFiles = *req.ExcludeFiles
+	}
+	if req.Retrieval != nil {
+		projectConfig.Retrieval = *req.Retrieval
+	}
+	// Only the settings are written, a running index job owns the rest
+	err := ca.updateProject(projectConfig.ProjectName, func(config *ProjectConfig) {
+		config.ProjectPath = projectConfig.ProjectPath
+		config.ExcludeFolders = projectConfig.ExcludeFolders
+		config.ExcludeFiles = projectConfig.ExcludeFiles
+		config.Retrieval = projectConfig.Retrieval
+		projectConfig = *config
+	})
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal", fmt.Sprintf("error saving project config: %v", err))
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, ProjectDetails{ProjectConfig: projectConfig, Stats: ca.projectStats(projectConfig)})
+}
+
+func (ca *CodeAssistant) apiDeleteProject(w http.ResponseWriter, r *http.Request) {
+	projectConfig, ok := ca.apiProject(w, r, RoleAdmin)
+	if !ok {
+		return
+	}
+	if err := ca.deleteProject(projectConfig); errors.Is(err, errProjectBusy) {
+		writeAPIError(w, http.StatusConflict, "project_busy", err.Error())
+		return
+	} else if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal", err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (ca *CodeAssistant) apiIndexProject(w http.ResponseWriter, r *http.Request) {
+	projectConfig, ok := ca.apiProject(w, r, RoleMaintainer)
+	if !ok {
+		return
+	}
+	resume, _ := strconv.ParseBool(r.URL.Query().Get("resume"))
+	job, err := ca.startReindexJob(projectConfig.ProjectName, ReindexOptions{Resume: resume})
+	if err != nil {
+		writeAPIError(w, http.StatusConflict, "project_busy", err.Error())
+		return
+	}
+	w.Header().Set("Location", "/api/v1/jobs/"+job.id)
+	writeAPIJSON(w, http.StatusAccepted, job.Snapshot())
+}
+
+func (ca *CodeAssistant) apiReindexProject(w http.ResponseWriter, r *http.Request) {
+	projectConfig, ok := ca.apiProject(w, r, RoleMaintainer)
+	if !ok {
+		return
+	}
+	wipe, _ := strconv.ParseBool(r.URL.Query().Get("wipe"))
+	job, err := ca.startReindexJob(projectConfig.ProjectName, ReindexOptions{Wipe: wipe})
+	if err != nil {
+		writeAPIError(w, http.StatusConflict, "project_busy", err.Error())
+		return
+	}
+	w.Header().Set("Location", "/api/v1/jobs/"+job.id)
+	writeAPIJSON(w, http.StatusAccepted, job.Snapshot())
+}
+
+func (ca *CodeAssistant) apiListFailedFiles(w http.ResponseWriter, r *http.Request) {
+	projectConfig, ok := ca.apiProject(w, r, RoleViewer)
+	if !ok {
+		return
+	}
+	failed, err := ca.failedFiles(projectConfig.ProjectName)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal", fmt.Sprintf("error listing failed files: %v", err))
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, failed)
+}
+
+func (ca *CodeAssistant) apiRetryFailed(w http.ResponseWriter, r *http.Request) {
+	projectConfig, ok := ca.apiProject(w, r, RoleMaintainer)
+	if !ok {
+		return
+	}
+	job, err := ca.startReindexJob(projectConfig.ProjectName, ReindexOptions{RetryFailed: true})
+	if err != nil {
+		writeAPIError(w, http.StatusConflict, "project_busy", err.Error())
+		return
+	}
+	w.Header().Set("Location", "/api/v1/jobs/"+job.id)
+	writeAPIJSON(w, http.StatusAccepted, job.Snapshot())
+}
+
+func (ca *CodeAssistant) apiAsk(w http.ResponseWriter, r *http.Request) {
+	projectConfig, ok := ca.apiProject(w, r, RoleViewer)
+	if !ok {
+		return
+	}
+	var req struct {
+		Query     string `json:"query"`
+		SessionID string `json:"session_id"` // Continue an earlier conversation
+		RetrievalConfig
+	}
+	if !decodeAPIBody(w, r, &req) {
+		return
+	}
+	if strings.TrimSpace(req.Query) == "" {
+		writeAPIError(w, http.StatusBadRequest, "invalid_query", "query is required")
+		return
+	}
+
+	session, err := ca.openChatSession(r.Context(), projectConfig.ProjectName, req.SessionID, req.Query)
+	if err == errChatSessionNotFound {
+		writeAPIError(w, http.StatusNotFound, "session_not_found", err.Error())
+		return
+	} else if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal", fmt.Sprintf("error opening chat session: %v", err))
+		return
+	}
+
+	answer, sources, err := ca.askInSession(r.Context(), &session, req.Query, req.RetrievalConfig, nil)
+	if errors.Is(err, errLLMUnavailable) {
+		writeAPIError(w, http.StatusServiceUnavailable, "llm_unavailable", err.Error())
+		return
+	} else if err != nil {
+		writeAPIError(w, http.StatusBadGateway, "llm_error", fmt.Sprintf("error searching codebase: %v", err))
+		return
+	}
+	if sources == nil {
+		sources = []Source{}
+	}
+	writeAPIJSON(w, http.StatusOK, AskResult{
+		Project:   projectConfig.ProjectName,
+		SessionID: session.ID,
+		Query:     req.Query,
+		Answer:    answer,
+		Sources:   sources,
+	})
+}
+
+func (ca *CodeAssistant) apiListChatSessions(w http.ResponseWriter, r *http.Request) {
+	projectConfig, ok := ca.apiProject(w, r, RoleViewer)
+	if !ok {
+		return
+	}
+	username, allUsers := ca.sessionOwner(r.Context())
+	sessions, err := ca.listChatSessions(projectConfig.ProjectName, username, allUsers)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal", fmt.Sprintf("error listing chat sessions: %v", err))
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, sessions)
+}
+
+// apiChatSession loads the session named in the URL, writing an error
+// response unless the caller owns it and may still view its project.
+func (ca *CodeAssistant) apiChatSession(w http.ResponseWriter, r *http.Request) (ChatSession, bool) {
+	session, err := ca.getChatSession(r.PathValue("id"))
+	if err == sql.ErrNoRows || (err == nil && !ca.callerOwnsSession(r.Context(), session)) {
+		writeAPIError(w, http.StatusNotFound, "session_not_found", errChatSessionNotFound.Error())
+		return ChatSession{}, false
+	} else if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal", fmt.Sprintf("error loading chat session: %v", err))
+		return ChatSession{}, false
+	}
+	if !ca.authorize(w, r, session.Project, RoleViewer) {
+		return ChatSession{}, false
+	}
+	return session, true
+}
+
+func (ca *CodeAssistant) apiGetChatSession(w http.ResponseWriter, r *http.Request) {
+	session, ok := ca.apiChatSession(w, r)
+	if !ok {
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, session)
+}
+
+func (ca *CodeAssistant) apiDeleteChatSession(w http.ResponseWriter, r *http.Request) {
+	session, ok := ca.apiChatSession(w, r)
+	if !ok {
+		return
+	}
+	if err := ca.deleteChatSession(session.ID); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal", fmt.Sprintf("error deleting chat session: %v", err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (ca *CodeAssistant) apiListCommits(w http.ResponseWriter, r *http.Request) {
+	projectConfig, ok := ca.apiProject(w, r, RoleViewer)
+	if !ok {
+		return
+	}
+	limit := 20
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > 500 {
+			writeAPIError(w, http.StatusBadRequest, "invalid_limit", "limit must be between 1 and 500")
+			return
+		}
+		limit = n
+	}
+
+	commits, err := getCommitLog(projectConfig.ProjectPath, limit)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "git_error", fmt.Sprintf("failed to get commit list: %v", err))
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, commits)
+}
+
+func (ca *CodeAssistant) apiReviewCommit(w http.ResponseWriter, r *http.Request) {
+	projectConfig, ok := ca.apiProject(w, r, RoleMaintainer)
+	if !ok {
+		return
+	}
+	var req struct {
+		Commit string `json:"commit"`
+	}
+	if !decodeAPIBody(w, r, &req) {
+		return
+	}
+	// Refuse anything git could parse as an option
+	if req.Commit == "" || strings.HasPrefix(req.Commit, "-") {
+		writeAPIError(w, http.StatusBadRequest, "invalid_commit", "a commit is required")
+		return
+	}
+
+	review, err := ca.reviewCommitHash(r.Context(), projectConfig.ProjectPath, req.Commit)
+	if err != nil {
+		writeAPIError(w, http.StatusBadGateway, "review_failed", err.Error())
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, ReviewResult{Project: projectConfig.ProjectName, Commit: req.Commit, Review: review})
+}
+
+func (ca *CodeAssistant) apiListMembers(w http.ResponseWriter, r *http.Request) {
+	projectConfig, ok := ca.apiProject(w, r, RoleAdmin)
+	if !ok {
+		return
+	}
+	members, err := ca.userRoles(projectConfig.ProjectName)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal", fmt.Sprintf("error listing members: %v", err))
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, members)
+}
+
+func (ca *CodeAssistant) apiSetMember(w http.ResponseWriter, r *http.Request) {
+	projectConfig, ok := ca.apiProject(w, r, RoleAdmin)
+	if !ok {
+		return
+	}
+	var req struct {
+		Role string `json:"role"`
+	}
+	if !decodeAPIBody(w, r, &req) {
+		return
+	}
+	role, err := parseRole(req.Role)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_role", err.Error())
+		return
+	}
+	username := r.PathValue("username")
+	if err := ca.setRole(username, projectConfig.ProjectName, role); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_member", err.Error())
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, map[string]string{"username": username, "project": projectConfig.ProjectName, "role": role.String()})
+}
+
+func (ca *CodeAssistant) apiRemoveMember(w http.ResponseWriter, r *http.Request) {
+	projectConfig, ok := ca.apiProject(w, r, RoleAdmin)
+	if !ok {
+		return
+	}
+	if err := ca.removeRole(r.PathValue("username"), projectConfig.ProjectName); err != nil {
+		writeAPIError(w, http.StatusNotFound, "member_not_found", err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (ca *CodeAssistant) apiListUsers(w http.ResponseWriter, r *http.Request) {
+	if !ca.authorize(w, r, allProjects, RoleAdmin) {
+		return
+	}
+	users, err := ca.userRoles("")
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal", fmt.Sprintf("error listing users: %v", err))
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, users)
+}
+
+func (ca *CodeAssistant) apiCreateUser(w http.ResponseWriter, r *http.Request) {
+	if !ca.authorize(w, r, allProjects, RoleAdmin) {
+		return
+	}
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if !decodeAPIBody(w, r, &req) {
+		return
+	}
+	if err := ca.createUser(req.Username, req.Password); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_user", err.Error())
+		return
+	}
+	writeAPIJSON(w, http.StatusCreated, UserRoles{Username: req.Username, Roles: map[string]string{}})
+}
+
+func (ca *CodeAssistant) apiDeleteUser(w http.ResponseWriter, r *http.Request) {
+	if !ca.authorize(w, r, allProjects, RoleAdmin) {
+		return
+	}
+	if err := ca.deleteUser(r.PathValue("username")); err != nil {
+		writeAPIError(w, http.StatusNotFound, "user_not_found", err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (ca *CodeAssistant) apiListJobs(w http.ResponseWriter, r *http.Request) {
+	writeAPIJSON(w, http.StatusOK, ca.visibleJobs(r.Context(), ca.jobs.List()))
+}
+
+func (ca *CodeAssistant) apiGetJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := ca.jobs.Get(r.PathValue("id"))
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "job_not_found", "job not found")
+		return
+	}
+	if !ca.authorize(w, r, job.project, RoleViewer) {
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, job.Snapshot())
+}
+
+func (ca *CodeAssistant) apiListModels(w http.ResponseWriter, r *http.Request) {
+	writeAPIJSON(w, http.StatusOK, ca.models.list())
+}
+
+// projectStats counts the generated docs, tracked file hashes and embedded
+// documents of a project. Missing data counts as zero.
+func (ca *CodeAssistant) projectStats(projectConfig ProjectConfig) ProjectStats {
+	var stats ProjectStats
+
+	projectDocsDir := filepath.Join(ca.config.DocsDir, projectConfig.ProjectName)
+	filepath.Walk(projectDocsDir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && strings.HasSuffix(path, ".txt") {
+			stats.DocFiles++
+		}
+		return nil
+	})
+
+	ca.db.QueryRow("SELECT COUNT(*) FROM file_hashes WHERE project = ?", projectConfig.ProjectName).Scan(&stats.TrackedFiles)
+
+	if vectorDB := ca.vectorDB.Load(); vectorDB != nil {
+		if collec, _ := ca.projectCollection(vectorDB, projectConfig.ProjectName); collec != nil {
+			stats.VectorDocCount = collec.Count()
+		}
+	}
+	return stats
+}
+
+// deleteProject removes a project with its generated docs, file hashes,
+// vector collection, roles and chat sessions. It fails with errProjectBusy
+// while the project is being indexed. The rows are deleted in one
+// transaction, the projects row last, and the docs and collection only once
+// it has committed, so a failure never leaves a project without its data or
+// grants without their project.
+func (ca *CodeAssistant) deleteProject(projectConfig ProjectConfig) error {
+	unlock, err := ca.registry.lock(projectConfig.ProjectName, "being deleted")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	tx, err := ca.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, stmt := range []struct{ query, what string }{
+		{"DELETE FROM file_hashes WHERE project = ?", "file hashes"},
+		{"DELETE FROM index_run_files WHERE run_id IN (SELECT id FROM index_runs WHERE project = ?)", "index journal"},
+		{"DELETE FROM index_runs WHERE project = ?", "index journal"},
+		{"DELETE FROM failed_files WHERE project = ?", "failed files"},
+		{"DELETE FROM project_roles WHERE project = ?", "project roles"},
+		{"DELETE FROM chat_messages WHERE session_id IN (SELECT id FROM chat_sessions WHERE project = ?)", "chat messages"},
+		{"DELETE FROM chat_sessions WHERE project = ?", "chat sessions"},
+		{"DELETE FROM vector_collections WHERE project = ?", "vector collection"},
+		{"DELETE FROM projects WHERE name = ?", "project"},
+	} {
+		if _, err := tx.Exec(stmt.query, projectConfig.ProjectName); err != nil {
+			return fmt.Errorf("failed to delete %s: %v", stmt.what, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to delete project: %v", err)
+	}
+
+	if err := os.RemoveAll(filepath.Join(ca.config.DocsDir, projectConfig.ProjectName)); err != nil {
+		return fmt.Errorf("failed to delete docs: %v", err)
+	}
+	if err := ca.deleteVectorCollection(projectConfig.ProjectName); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to delete vector collection: %v", err)
+	}
+	return nil
+}
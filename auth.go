@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// AuthConfig controls who may use the web server
+type AuthConfig struct {
+	Enabled         bool     `json:"enabled"`           // Require a login or API token for every request
+	APITokens       []string `json:"api_tokens"`        // Static bearer tokens for scripts and integrations
+	SessionTTLHours int      `json:"session_ttl_hours"` // How long a login stays valid
+}
+
+const (
+	sessionCookieName = "codesage_session"
+	csrfFormField     = "csrf_token"
+	csrfHeader        = "X-CSRF-Token"
+	defaultSessionTTL = 24 * time.Hour
+)
+
+// Principal is the authenticated caller of a web request
+type Principal struct {
+	Username  string // Empty for API token callers
+	CSRFToken string // Empty for API token callers, which are not exposed to CSRF
+	APIToken  bool
+	Local     bool // The CLI user, who may do anything
+}
+
+type principalKey struct{}
+
+// principalFromContext returns the caller attached by requireAuth, if any.
+func principalFromContext(ctx context.Context) (Principal, bool) {
+	principal, ok := ctx.Value(principalKey{}).(Principal)
+	return principal, ok
+}
+
+// randomToken returns n random bytes as hex.
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// hashToken hashes a session token before it is stored so a leaked database
+// does not leak live sessions.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// dummyPasswordHash is compared against when a login names an unknown user
+var dummyPasswordHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("codesage"), bcrypt.DefaultCost)
+	return hash
+})
+
+// createUser adds a web user or replaces the password of an existing one.
+func (ca *CodeAssistant) createUser(username, password string) error {
+	if username == "" || strings.ContainsAny(username, " \t\n") {
+		return fmt.Errorf("invalid username %q", username)
+	}
+	if len(password) < 8 {
+		return fmt.Errorf("password must be at least 8 characters")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %v", err)
+	}
+	_, err = ca.db.Exec(`INSERT INTO users (username, password_hash, created_at) VALUES (?, ?, ?)
+		ON CONFLICT(username) DO UPDATE SET password_hash = excluded.password_hash`, username, string(hash), time.Now())
+	return err
+}
+
+// deleteUser removes a web user with all of their roles and sessions.
+func (ca *CodeAssistant) deleteUser(username string) error {
+	tx, err := ca.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM project_roles WHERE username = ?", username); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM web_sessions WHERE username = ?", username); err != nil {
+		return err
+	}
+	result, err := tx.Exec("DELETE FROM users WHERE username = ?", username)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("user %s not found", username)
+	}
+	return tx.Commit()
+}
+
+// authenticateUser checks a username and password against the stored bcrypt hash.
+func (ca *CodeAssistant) authenticateUser(username, password string) (bool, error) {
+	var hash string
+	err := ca.db.QueryRow("SELECT password_hash FROM users WHERE username = ?", username).Scan(&hash)
+	if err == sql.ErrNoRows {
+		// Spend the same time as a real check so usernames cannot be probed
+		bcrypt.CompareHashAndPassword(dummyPasswordHash(), []byte(password))
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil, nil
+}
+
+// sessionTTL returns the configured login lifetime.
+func (ca *CodeAssistant) sessionTTL() time.Duration {
+	if ca.config.Auth.SessionTTLHours > 0 {
+		return time.Duration(ca.config.Auth.SessionTTLHours) * time.Hour
+	}
+	return defaultSessionTTL
+}
+
+// createSession starts a login session and returns its token.
+func (ca *CodeAssistant) createSession(username string) (string, time.Time, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	csrfToken, err := randomToken(32)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	expiresAt := time.Now().UTC().Add(ca.sessionTTL())
+
+	// Drop expired sessions while we are here
+	ca.db.Exec("DELETE FROM web_sessions WHERE expires_at < ?", time.Now().UTC())
+
+	_, err = ca.db.Exec("INSERT INTO web_sessions (token_hash, username, csrf_token, expires_at) VALUES (?, ?, ?, ?)",
+		hashToken(token), username, csrfToken, expiresAt)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return token, expiresAt, nil
+}
+
+// lookupSession returns the caller for a session token, or false when the
+// session is unknown or expired.
+func (ca *CodeAssistant) lookupSession(token string) (Principal, bool, error) {
+	var principal Principal
+	var expiresAt time.Time
+	err := ca.db.QueryRow("SELECT username, csrf_token, expires_at FROM web_sessions WHERE token_hash = ?", hashToken(token)).
+		Scan(&principal.Username, &principal.CSRFToken, &expiresAt)
+	if err == sql.ErrNoRows {
+		return Principal{}, false, nil
+	} else if err != nil {
+		return Principal{}, false, err
+	}
+	if time.Now().After(expiresAt) {
+		ca.db.Exec("DELETE FROM web_sessions WHERE token_hash = ?", hashToken(token))
+		return Principal{}, false, nil
+	}
+	return principal, true, nil
+}
+
+// validAPIToken reports whether token is one of the configured API tokens.
+func (ca *CodeAssistant) validAPIToken(token string) bool {
+	valid := false
+	for _, apiToken := range ca.config.Auth.APITokens {
+		if apiToken != "" && subtle.ConstantTimeCompare([]byte(apiToken), []byte(token)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
+
+// isPublicPath reports whether a path is reachable without logging in.
+func isPublicPath(path string) bool {
+	return path == "/login" || strings.HasPrefix(path, "/static/")
+}
+
+// isAPIRequest reports whether the caller expects JSON errors instead of a login redirect.
+func isAPIRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/api/") || wantsJSON(r)
+}
+
+// requireAuth wraps the web server's handler. When auth is enabled every
+// request except the login page and static files needs a valid session
+// cookie or API token, and state-changing requests made with a session
+// cookie must carry the session's CSRF token.
+func (ca *CodeAssistant) requireAuth(next http.Handler) http.Handler {
+	if !ca.config.Auth.Enabled {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isPublicPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			if !ca.validAPIToken(token) {
+				writeAPIError(w, http.StatusUnauthorized, "unauthorized", "invalid API token")
+				return
+			}
+			ctx := context.WithValue(r.Context(), principalKey{}, Principal{APIToken: true})
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+
+		var principal Principal
+		authenticated := false
+		if cookie, err := r.Cookie(sessionCookieName); err == nil {
+			principal, authenticated, err = ca.lookupSession(cookie.Value)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Error checking session: %v", err), http.StatusInternalServerError)
+				return
+			}
+		}
+		if !authenticated {
+			if isAPIRequest(r) {
+				writeAPIError(w, http.StatusUnauthorized, "unauthorized", "login or API token required")
+				return
+			}
+			http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		default:
+			token := r.Header.Get(csrfHeader)
+			if token == "" {
+				token = r.FormValue(csrfFormField)
+			}
+			if subtle.ConstantTimeCompare([]byte(token), []byte(principal.CSRFToken)) != 1 {
+				if isAPIRequest(r) {
+					writeAPIError(w, http.StatusForbidden, "csrf_failed", "missing or invalid CSRF token")
+					return
+				}
+				http.Error(w, "Missing or invalid CSRF token", http.StatusForbidden)
+				return
+			}
+		}
+
+		ctx := context.WithValue(r.Context(), principalKey{}, principal)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// safeRedirect only allows redirects to paths on this server.
+func safeRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+// loginHandler shows the login form (GET) and starts a session (POST).
+func (ca *CodeAssistant) loginHandler(w http.ResponseWriter, r *http.Request) {
+	data := map[string]string{
+		"Next": safeRedirect(r.FormValue("next")),
+	}
+
+	if r.Method != http.MethodPost {
+		ca.renderTemplate(w, r, "templates/login.html", data)
+		return
+	}
+
+	username := r.FormValue("username")
+	ok, err := ca.authenticateUser(username, r.FormValue("password"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error checking login: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		data["Error"] = "Invalid username or password"
+		w.WriteHeader(http.StatusUnauthorized)
+		ca.renderTemplate(w, r, "templates/login.html", data)
+		return
+	}
+
+	token, expiresAt, err := ca.createSession(username)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error creating session: %v", err), http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  expiresAt,
+		HttpOnly: true,
+		Secure:   ca.config.TLSCertFile != "",
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, data["Next"], http.StatusSeeOther)
+}
+
+// logoutHandler ends the caller's session.
+func (ca *CodeAssistant) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		ca.db.Exec("DELETE FROM web_sessions WHERE token_hash = ?", hashToken(cookie.Value))
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
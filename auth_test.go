@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const testPassword = "correct horse"
+
+// newAuthAssistant returns an assistant with auth enabled, an API token, the
+// projects alpha and beta, and these users: vera is a viewer and max a
+// maintainer of alpha, ada an admin of every project and nora has no role.
+func newAuthAssistant(t *testing.T) *CodeAssistant {
+	t.Helper()
+	ca := newTestAssistant(t)
+	ca.config.Auth = AuthConfig{Enabled: true, APITokens: []string{"script-token"}}
+	for _, name := range []string{"alpha", "beta"} {
+		if err := ca.saveProjectConfig(ProjectConfig{ProjectName: name, ProjectPath: t.TempDir()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, user := range []struct {
+		name    string
+		project string
+		role    Role
+	}{
+		{"vera", "alpha", RoleViewer},
+		{"max", "alpha", RoleMaintainer},
+		{"ada", allProjects, RoleAdmin},
+		{"nora", "", RoleNone},
+	} {
+		if err := ca.createUser(user.name, testPassword); err != nil {
+			t.Fatal(err)
+		}
+		if user.role != RoleNone {
+			if err := ca.setRole(user.name, user.project, user.role); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return ca
+}
+
+// webClient sends requests to the web server as one caller.
+type webClient struct {
+	t       *testing.T
+	handler http.Handler
+	cookie  *http.Cookie // Session cookie, nil when not logged in
+	csrf    string       // Sent with state-changing requests when set
+	token   string       // API token, sent as a bearer token when set
+}
+
+// login logs username in through the login form.
+func login(t *testing.T, ca *CodeAssistant, username string) *webClient {
+	t.Helper()
+	client := &webClient{t: t, handler: ca.newWebServer().Handler}
+	form := url.Values{"username": {username}, "password": {testPassword}, "next": {"/jobs"}}
+	rec := client.do(http.MethodPost, "/login", form.Encode())
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/jobs" {
+		t.Fatalf("login of %s got %d to %q, want a redirect to /jobs", username, rec.Code, rec.Header().Get("Location"))
+	}
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == sessionCookieName {
+			client.cookie = cookie
+		}
+	}
+	if client.cookie == nil || !client.cookie.HttpOnly {
+		t.Fatalf("login of %s set no HttpOnly session cookie", username)
+	}
+	principal, ok, err := ca.lookupSession(client.cookie.Value)
+	if err != nil || !ok || principal.Username != username {
+		t.Fatalf("the session cookie is for %+v, %v", principal, err)
+	}
+	client.csrf = principal.CSRFToken
+	return client
+}
+
+// do sends a request, with a JSON body for API paths and a form otherwise.
+func (c *webClient) do(method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if strings.HasPrefix(path, "/api/") {
+		req.Header.Set("Content-Type", "application/json")
+	} else {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if c.cookie != nil {
+		req.AddCookie(c.cookie)
+	}
+	if c.csrf != "" && method != http.MethodGet {
+		req.Header.Set(csrfHeader, c.csrf)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	rec := httptest.NewRecorder()
+	c.handler.ServeHTTP(rec, req)
+	return rec
+}
+
+// projectNames lists the projects the caller sees through the API.
+func (c *webClient) projectNames() []string {
+	c.t.Helper()
+	rec := c.do(http.MethodGet, "/api/v1/projects", "")
+	if rec.Code != http.StatusOK {
+		c.t.Fatalf("listing projects got %d %s", rec.Code, rec.Body)
+	}
+	var projects []ProjectConfig
+	if err := json.Unmarshal(rec.Body.Bytes(), &projects); err != nil {
+		c.t.Fatal(err)
+	}
+	names := []string{}
+	for _, project := range projects {
+		names = append(names, project.ProjectName)
+	}
+	return names
+}
+
+func TestLoginAndSessions(t *testing.T) {
+	ca := newAuthAssistant(t)
+	anonymous := &webClient{t: t, handler: ca.newWebServer().Handler}
+
+	// Without a login the API answers 401 and pages redirect to the login form
+	if rec := anonymous.do(http.MethodGet, "/api/v1/projects", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("API without a login got %d, want 401", rec.Code)
+	}
+	if rec := anonymous.do(http.MethodGet, "/jobs", ""); rec.Code != http.StatusSeeOther || !strings.HasPrefix(rec.Header().Get("Location"), "/login") {
+		t.Errorf("page without a login got %d to %q, want a redirect to /login", rec.Code, rec.Header().Get("Location"))
+	}
+
+	// A wrong password or unknown user is refused without a session
+	for _, username := range []string{"vera", "nobody"} {
+		form := url.Values{"username": {username}, "password": {"wrong password"}}
+		rec := anonymous.do(http.MethodPost, "/login", form.Encode())
+		if rec.Code != http.StatusUnauthorized || len(rec.Result().Cookies()) != 0 {
+			t.Errorf("bad login of %s got %d with cookies %v, want 401 without", username, rec.Code, rec.Result().Cookies())
+		}
+	}
+
+	vera := login(t, ca, "vera")
+	if rec := vera.do(http.MethodGet, "/api/v1/projects/alpha", ""); rec.Code != http.StatusOK {
+		t.Errorf("logged in viewer got %d, want 200", rec.Code)
+	}
+
+	// Logging out ends the session
+	if rec := vera.do(http.MethodPost, "/logout", ""); rec.Code != http.StatusSeeOther {
+		t.Fatalf("logout got %d", rec.Code)
+	}
+	if rec := vera.do(http.MethodGet, "/api/v1/projects/alpha", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("request after logout got %d, want 401", rec.Code)
+	}
+}
+
+func TestAPITokens(t *testing.T) {
+	ca := newAuthAssistant(t)
+	script := &webClient{t: t, handler: ca.newWebServer().Handler, token: "script-token"}
+
+	// Tokens act as admins and are not exposed to CSRF
+	if names := script.projectNames(); !slices.Equal(names, []string{"alpha", "beta"}) {
+		t.Errorf("token sees %v, want every project", names)
+	}
+	if rec := script.do(http.MethodPatch, "/api/v1/projects/beta", `{"exclude_folders": ["vendor"]}`); rec.Code != http.StatusOK {
+		t.Errorf("token PATCH got %d %s, want 200", rec.Code, rec.Body)
+	}
+
+	script.token = "wrong-token"
+	if rec := script.do(http.MethodGet, "/api/v1/projects", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("invalid token got %d, want 401", rec.Code)
+	}
+}
+
+func TestCSRFProtection(t *testing.T) {
+	ca := newAuthAssistant(t)
+	max := login(t, ca, "max")
+	csrf := max.csrf
+
+	// State-changing requests made with the session cookie need its CSRF token
+	max.csrf = ""
+	if rec := max.do(http.MethodPatch, "/api/v1/projects/alpha", `{"exclude_folders": ["vendor"]}`); rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "csrf_failed") {
+		t.Errorf("PATCH without a CSRF token got %d %s, want 403 csrf_failed", rec.Code, rec.Body)
+	}
+	if rec := max.do(http.MethodPost, "/logout", ""); rec.Code != http.StatusForbidden {
+		t.Errorf("form POST without a CSRF token got %d, want 403", rec.Code)
+	}
+	max.csrf = "not-the-token"
+	if rec := max.do(http.MethodPatch, "/api/v1/projects/alpha", `{"exclude_folders": ["vendor"]}`); rec.Code != http.StatusForbidden {
+		t.Errorf("PATCH with a wrong CSRF token got %d, want 403", rec.Code)
+	}
+
+	// The token is accepted as a header and as a form field
+	max.csrf = csrf
+	if rec := max.do(http.MethodPatch, "/api/v1/projects/alpha", `{"exclude_folders": ["vendor"]}`); rec.Code != http.StatusOK {
+		t.Errorf("PATCH with the CSRF token got %d %s, want 200", rec.Code, rec.Body)
+	}
+	max.csrf = ""
+	if rec := max.do(http.MethodPost, "/logout", url.Values{csrfFormField: {csrf}}.Encode()); rec.Code != http.StatusSeeOther {
+		t.Errorf("logout with the CSRF form field got %d, want 303", rec.Code)
+	}
+}
+
+func TestRolesInHandlers(t *testing.T) {
+	ca := newAuthAssistant(t)
+	clients := map[string]*webClient{}
+	for _, username := range []string{"vera", "max", "ada", "nora"} {
+		clients[username] = login(t, ca, username)
+	}
+	reindex := url.Values{"kind": {"reindex"}, "project_name": {"alpha"}}.Encode()
+
+	for _, test := range []struct {
+		user   string
+		method string
+		path   string
+		body   string
+		want   int
+	}{
+		{"vera", http.MethodGet, "/api/v1/projects/alpha", "", http.StatusOK},
+		{"vera", http.MethodGet, "/project/alpha", "", http.StatusOK},
+		{"vera", http.MethodGet, "/api/v1/projects/beta", "", http.StatusForbidden},
+		{"vera", http.MethodGet, "/project/beta", "", http.StatusForbidden},
+		{"vera", http.MethodPatch, "/api/v1/projects/alpha", `{"exclude_folders": []}`, http.StatusForbidden},
+		{"vera", http.MethodPost, "/jobs", reindex, http.StatusForbidden},
+		{"max", http.MethodPatch, "/api/v1/projects/alpha", `{"exclude_folders": []}`, http.StatusOK},
+		{"max", http.MethodGet, "/api/v1/projects/alpha/members", "", http.StatusForbidden},
+		{"max", http.MethodDelete, "/api/v1/projects/alpha", "", http.StatusForbidden},
+		{"max", http.MethodGet, "/api/v1/users", "", http.StatusForbidden},
+		{"ada", http.MethodGet, "/api/v1/projects/beta/members", "", http.StatusOK},
+		{"ada", http.MethodGet, "/api/v1/users", "", http.StatusOK},
+		{"nora", http.MethodGet, "/api/v1/projects/alpha", "", http.StatusForbidden},
+		{"nora", http.MethodGet, "/project/alpha", "", http.StatusForbidden},
+	} {
+		rec := clients[test.user].do(test.method, test.path, test.body)
+		if rec.Code != test.want {
+			t.Errorf("%s %s %s got %d %s, want %d", test.user, test.method, test.path, rec.Code, rec.Body, test.want)
+		}
+	}
+
+	// Projects are listed only to users with a role on them
+	for user, want := range map[string][]string{
+		"vera": {"alpha"},
+		"max":  {"alpha"},
+		"ada":  {"alpha", "beta"},
+		"nora": {},
+	} {
+		if names := clients[user].projectNames(); !slices.Equal(names, want) {
+			t.Errorf("%s sees projects %v, want %v", user, names, want)
+		}
+	}
+}
+
+func TestRoleForWithoutPrincipal(t *testing.T) {
+	ca := newAuthAssistant(t)
+
+	// Code that lost the caller's context must not act as an admin
+	if role, err := ca.roleFor(context.Background(), "alpha"); err != nil || role != RoleNone {
+		t.Errorf("got %s, %v without a principal, want none", role, err)
+	}
+	if names, err := ca.listProjects(context.Background()); err != nil || len(names) != 0 {
+		t.Errorf("got projects %v, %v without a principal, want none", names, err)
+	}
+
+	// The CLI acts as the local user, who may do anything
+	if role, err := ca.roleFor(ca.ctx, "alpha"); err != nil || role != RoleAdmin {
+		t.Errorf("got %s, %v for the CLI, want admin", role, err)
+	}
+
+	// Every caller is an admin while auth is disabled
+	ca.config.Auth.Enabled = false
+	if role, err := ca.roleFor(context.Background(), "alpha"); err != nil || role != RoleAdmin {
+		t.Errorf("got %s, %v with auth disabled, want admin", role, err)
+	}
+}
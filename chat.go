@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultChatHistoryTokens is how much earlier conversation is sent with a
+	// question when chat_history_tokens is not configured
+	defaultChatHistoryTokens = 2048
+	// keepRecentMessages are never folded into the summary so follow-up
+	// questions always see the last two turns verbatim
+	keepRecentMessages = 4
+)
+
+// errChatSessionNotFound is returned for sessions that do not exist, belong to
+// another project or belong to another user
+var errChatSessionNotFound = errors.New("chat session not found")
+
+// ChatSession is a persisted conversation about one project
+type ChatSession struct {
+	ID        string        `json:"id"`
+	Project   string        `json:"project"`
+	Username  string        `json:"username,omitempty"`
+	Title     string        `json:"title"`
+	CreatedAt time.Time     `json:"created_at"`
+	UpdatedAt time.Time     `json:"updated_at"`
+	Messages  []ChatMessage `json:"messages,omitempty"`
+
+	summary           string // Summary of the messages up to summarizedThrough
+	summarizedThrough int64  // ID of the last message folded into summary
+}
+
+// ChatMessage is one question or answer in a chat session
+type ChatMessage struct {
+	ID        int64     `json:"id"`
+	Role      string    `json:"role"` // "user" or "assistant"
+	Content   string    `json:"content"`
+	Sources   []Source  `json:"sources,omitempty"` // Docs retrieved for an answer
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// createChatSession starts a new conversation owned by username.
+func (ca *CodeAssistant) createChatSession(project, username, title string) (ChatSession, error) {
+	id, err := randomToken(8)
+	if err != nil {
+		return ChatSession{}, err
+	}
+	if runes := []rune(strings.TrimSpace(title)); len(runes) > 60 {
+		title = string(runes[:60]) + "…"
+	}
+	now := time.Now()
+	session := ChatSession{ID: id, Project: project, Username: username, Title: title, CreatedAt: now, UpdatedAt: now}
+	_, err = ca.db.Exec("INSERT INTO chat_sessions (id, project, username, title, summary, summarized_through, created_at, updated_at) VALUES (?, ?, ?, ?, '', 0, ?, ?)",
+		session.ID, session.Project, session.Username, session.Title, now, now)
+	if err != nil {
+		return ChatSession{}, fmt.Errorf("failed to create chat session: %v", err)
+	}
+	return session, nil
+}
+
+// getChatSession loads a session with all of its messages. It returns
+// sql.ErrNoRows when the session does not exist.
+func (ca *CodeAssistant) getChatSession(id string) (ChatSession, error) {
+	var session ChatSession
+	err := ca.db.QueryRow("SELECT id, project, username, title, summary, summarized_through, created_at, updated_at FROM chat_sessions WHERE id = ?", id).
+		Scan(&session.ID, &session.Project, &session.Username, &session.Title, &session.summary, &session.summarizedThrough, &session.CreatedAt, &session.UpdatedAt)
+	if err != nil {
+		return ChatSession{}, err
+	}
+	session.Messages, err = ca.chatMessages(id, 0)
+	if err != nil {
+		return ChatSession{}, err
+	}
+	return session, nil
+}
+
+// listChatSessions returns a project's sessions owned by username, or by
+// anyone when allUsers is set, most recently used first.
+func (ca *CodeAssistant) listChatSessions(project, username string, allUsers bool) ([]ChatSession, error) {
+	query := "SELECT id, project, username, title, created_at, updated_at FROM chat_sessions WHERE project = ?"
+	args := []interface{}{project}
+	if !allUsers {
+		query += " AND username = ?"
+		args = append(args, username)
+	}
+	rows, err := ca.db.Query(query+" ORDER BY updated_at DESC", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []ChatSession{}
+	for rows.Next() {
+		var session ChatSession
+		if err := rows.Scan(&session.ID, &session.Project, &session.Username, &session.Title, &session.CreatedAt, &session.UpdatedAt); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// deleteChatSession removes a session and its messages.
+func (ca *CodeAssistant) deleteChatSession(id string) error {
+	if _, err := ca.db.Exec("DELETE FROM chat_messages WHERE session_id = ?", id); err != nil {
+		return err
+	}
+	_, err := ca.db.Exec("DELETE FROM chat_sessions WHERE id = ?", id)
+	return err
+}
+
+// chatMessages returns a session's messages with an ID greater than afterID, oldest first.
+func (ca *CodeAssistant) chatMessages(sessionID string, afterID int64) ([]ChatMessage, error) {
+	rows, err := ca.db.Query("SELECT id, role, content, sources, created_at FROM chat_messages WHERE session_id = ? AND id > ? ORDER BY id", sessionID, afterID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []ChatMessage{}
+	for rows.Next() {
+		var message ChatMessage
+		var sources sql.NullString
+		if err := rows.Scan(&message.ID, &message.Role, &message.Content, &sources, &message.CreatedAt); err != nil {
+			return nil, err
+		}
+		if sources.String != "" {
+			json.Unmarshal([]byte(sources.String), &message.Sources)
+		}
+		messages = append(messages, message)
+	}
+	return messages, rows.Err()
+}
+
+// appendChatMessage stores a message at the end of a session.
+func (ca *CodeAssistant) appendChatMessage(sessionID, role, content string, sources []Source) error {
+	var sourcesJSON []byte
+	if len(sources) > 0 {
+		var err error
+		if sourcesJSON, err = json.Marshal(sources); err != nil {
+			return err
+		}
+	}
+	now := time.Now()
+	if _, err := ca.db.Exec("INSERT INTO chat_messages (session_id, role, content, sources, created_at) VALUES (?, ?, ?, ?, ?)",
+		sessionID, role, content, string(sourcesJSON), now); err != nil {
+		return fmt.Errorf("failed to save chat message: %v", err)
+	}
+	_, err := ca.db.Exec("UPDATE chat_sessions SET updated_at = ? WHERE id = ?", now, sessionID)
+	return err
+}
+
+// estimateTokens roughly counts the tokens in text, about four characters each.
+func estimateTokens(text string) int {
+	return len(text)/4 + 1
+}
+
+// chatHistoryBudget returns how many tokens of earlier conversation to send.
+func (ca *CodeAssistant) chatHistoryBudget() int {
+	if ca.config.ChatHistoryTokens > 0 {
+		return ca.config.ChatHistoryTokens
+	}
+	return defaultChatHistoryTokens
+}
+
+// chatHistory returns the earlier turns of a session as chat messages. When
+// they no longer fit the history budget the older turns are summarized by the
+// chat model and the summary is saved so it is only computed once.
+func (ca *CodeAssistant) chatHistory(ctx context.Context, session *ChatSession) ([]Message, error) {
+	messages, err := ca.chatMessages(session.ID, session.summarizedThrough)
+	if err != nil {
+		return nil, err
+	}
+
+	size := estimateTokens(session.summary)
+	for _, message := range messages {
+		size += estimateTokens(message.Content)
+	}
+	if size > ca.chatHistoryBudget() && len(messages) > keepRecentMessages {
+		older := messages[:len(messages)-keepRecentMessages]
+		messages = messages[len(messages)-keepRecentMessages:]
+
+		summary, err := ca.summarizeChat(ctx, session.summary, older)
+		if err != nil {
+			// Answer without the older turns rather than not at all
+			fmt.Printf("Failed to summarize chat session %s: %v\n", session.ID, err)
+		} else {
+			session.summary = summary
+			session.summarizedThrough = older[len(older)-1].ID
+			if _, err := ca.db.Exec("UPDATE chat_sessions SET summary = ?, summarized_through = ? WHERE id = ?",
+				session.summary, session.summarizedThrough, session.ID); err != nil {
+				return nil, fmt.Errorf("failed to save chat summary: %v", err)
+			}
+		}
+	}
+
+	var history []Message
+	if session.summary != "" {
+		history = append(history, Message{
+			Role:    "system",
+			Content: "Summary of the earlier conversation about this codebase:\n" + session.summary,
+		})
+	}
+	for _, message := range messages {
+		history = append(history, Message{Role: message.Role, Content: message.Content})
+	}
+	return history, nil
+}
+
+// summarizeChat folds messages into the running summary of a conversation.
+func (ca *CodeAssistant) summarizeChat(ctx context.Context, summary string, messages []ChatMessage) (string, error) {
+	var transcript strings.Builder
+	for _, message := range messages {
+		fmt.Fprintf(&transcript, "%s: %s\n\n", message.Role, message.Content)
+	}
+	prompt := fmt.Sprintf(`Summarize this conversation about a codebase in a few sentences. Keep file paths, function names and open questions.
+
+Earlier summary: %s
+
+Conversation:
+%s`, summary, transcript.String())
+
+	req := ChatRequest{
+		Model:    ca.config.CodeChatModel,
+		Messages: []Message{{Role: "user", Content: prompt}},
+	}
+	var result strings.Builder
+	err := ca.chat(ctx, req, func(token string) error {
+		result.WriteString(token)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(result.String()), nil
+}
+
+// askInSession answers query as the next turn of a chat session and stores the
+// question and the answer with the docs it was based on. A new session is
+// deleted again when its first question fails.
+func (ca *CodeAssistant) askInSession(ctx context.Context, session *ChatSession, query string, retrieval RetrievalConfig, onToken func(string) error) (string, []Source, error) {
+	history, err := ca.chatHistory(ctx, session)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to load chat history: %v", err)
+	}
+
+	answer, sources, err := ca.searchCodebase(ctx, session.Project, query, history, retrieval, onToken)
+	if err != nil {
+		if len(history) == 0 {
+			// Don't keep sessions whose first question failed
+			ca.deleteChatSession(session.ID)
+		}
+		return "", nil, err
+	}
+
+	if err := ca.appendChatMessage(session.ID, "user", query, nil); err != nil {
+		return "", nil, err
+	}
+	if err := ca.appendChatMessage(session.ID, "assistant", answer, sources); err != nil {
+		return "", nil, err
+	}
+	return answer, sources, nil
+}
+
+// callerOwnsSession reports whether the caller may read and continue a
+// session. Sessions belong to the user who started them, while API token and
+// local callers have full access like they do for projects.
+func (ca *CodeAssistant) callerOwnsSession(ctx context.Context, session ChatSession) bool {
+	username, allUsers := ca.sessionOwner(ctx)
+	return allUsers || session.Username == username
+}
+
+// sessionOwner returns the username new sessions are stored under and whether
+// the caller may see every user's sessions.
+func (ca *CodeAssistant) sessionOwner(ctx context.Context) (string, bool) {
+	principal, ok := principalFromContext(ctx)
+	if !ca.config.Auth.Enabled || !ok {
+		return "", true
+	}
+	return principal.Username, principal.APIToken
+}
+
+// openChatSession resumes the caller's session id on project, or starts a new
+// session titled after query when id is empty.
+func (ca *CodeAssistant) openChatSession(ctx context.Context, project, id, query string) (ChatSession, error) {
+	if id == "" {
+		username, _ := ca.sessionOwner(ctx)
+		return ca.createChatSession(project, username, query)
+	}
+	session, err := ca.getChatSession(id)
+	if err == sql.ErrNoRows || (err == nil && (session.Project != project || !ca.callerOwnsSession(ctx, session))) {
+		return ChatSession{}, errChatSessionNotFound
+	}
+	return session, err
+}
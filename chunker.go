@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/philippgille/chromem-go"
+)
+
+const (
+	// maxChunkChars keeps every chunk well inside the embedding model's input
+	// limit (about 500 tokens)
+	maxChunkChars = 2000
+	// Up to chunkOverlapLines lines, and no more than chunkOverlapChars, are
+	// repeated at the start of the next chunk so text that spans a boundary
+	// can still be found
+	chunkOverlapLines = 3
+	chunkOverlapChars = 300
+)
+
+// sectionStart matches lines that begin a new function or section in the
+// generated docs: markdown headings, bold titles and declarations.
+var sectionStart = regexp.MustCompile(`^\s*(#{1,6}\s|\*\*[^*]+\*\*\s*:?\s*$|(func|def|class|function|interface|type|struct|public|private|protected)\s)`)
+
+// Chunk is a piece of a generated doc file. Lines are 1-based and inclusive.
+type Chunk struct {
+	Index     int
+	StartLine int
+	EndLine   int
+	Content   string
+}
+
+// chunkText splits text at function and section boundaries into chunks of at
+// most maxChunkChars, merging small sections and splitting large ones by line.
+// Every chunk after the first repeats the last few lines of the previous one.
+func chunkText(text string) []Chunk {
+	lines := strings.Split(strings.TrimRight(text, "\n"), "\n")
+	if len(lines) == 1 && lines[0] == "" {
+		return nil
+	}
+
+	// Find the sections, as [start, end) line ranges
+	var sections [][2]int
+	start := 0
+	for i := 1; i < len(lines); i++ {
+		if sectionStart.MatchString(lines[i]) {
+			sections = append(sections, [2]int{start, i})
+			start = i
+		}
+	}
+	sections = append(sections, [2]int{start, len(lines)})
+
+	size := func(from, to int) int {
+		n := 0
+		for _, line := range lines[from:to] {
+			n += len(line) + 1
+		}
+		return n
+	}
+
+	// Pack whole sections into chunks, splitting sections that are too big
+	// on their own at line boundaries
+	var ranges [][2]int
+	chunkStart, chunkEnd := 0, 0
+	for _, section := range sections {
+		if chunkEnd > chunkStart && size(chunkStart, section[1]) > maxChunkChars {
+			ranges = append(ranges, [2]int{chunkStart, chunkEnd})
+			chunkStart = section[0]
+		}
+		chunkEnd = section[1]
+		for size(chunkStart, chunkEnd) > maxChunkChars {
+			end := chunkStart + 1
+			for end < chunkEnd && size(chunkStart, end+1) <= maxChunkChars {
+				end++
+			}
+			ranges = append(ranges, [2]int{chunkStart, end})
+			chunkStart = end
+		}
+	}
+	if chunkEnd > chunkStart {
+		ranges = append(ranges, [2]int{chunkStart, chunkEnd})
+	}
+
+	chunks := make([]Chunk, 0, len(ranges))
+	for i, r := range ranges {
+		from := r[0]
+		for i > 0 && from > ranges[i-1][0]+1 && r[0]-from < chunkOverlapLines && size(from-1, r[0]) <= chunkOverlapChars {
+			from--
+		}
+		chunks = append(chunks, Chunk{
+			Index:     i,
+			StartLine: from + 1,
+			EndLine:   r[1],
+			Content:   strings.Join(lines[from:r[1]], "\n"),
+		})
+	}
+	return chunks
+}
+
+// chunkDocuments turns the generated doc of one source file into vector DB
+// documents, one per chunk. relPath is the source file relative to the
+// codebase and sourcePath its full path.
+func chunkDocuments(relPath, sourcePath, doc string) []chromem.Document {
+	var documents []chromem.Document
+	for _, chunk := range chunkText(doc) {
+		documents = append(documents, chromem.Document{
+			ID:      fmt.Sprintf("%s#%d", relPath, chunk.Index),
+			Content: chunk.Content,
+			Metadata: map[string]string{
+				"file_path":   sourcePath,
+				"rel_path":    relPath,
+				"chunk_index": strconv.Itoa(chunk.Index),
+				"start_line":  strconv.Itoa(chunk.StartLine),
+				"end_line":    strconv.Itoa(chunk.EndLine),
+			},
+		})
+	}
+	return documents
+}
@@ -0,0 +1,510 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// Exit codes returned by the non-interactive subcommands
+const (
+	exitOK    = 0
+	exitError = 1
+	exitUsage = 2
+)
+
+const cliUsage = `Usage: codesage [--config file] [--offline] <command> [flags]
+
+Commands:
+  index    --name NAME --path PATH [--exclude-dir a,b] [--exclude-file x,y]
+           --name NAME --resume          Continue the project's last unfinished run
+  reindex  NAME [--wipe | --resume]
+  retry-failed NAME                      Index again only the files that failed
+  ask      NAME "question" [--session ID] [--top-k N] [--min-similarity S] [--context-tokens N]
+  review   NAME [--commit SHA]
+  serve    Run only the web server, shutting down gracefully on SIGINT/SIGTERM
+  user     add NAME | delete NAME | list   Manage web login users (password read from stdin)
+           grant NAME PROJECT ROLE | revoke NAME PROJECT
+                                         Give or take a viewer, maintainer or admin role
+                                         (PROJECT "*" applies to every project)
+  db       migrate | status              Apply pending schema migrations or list them
+  models   Pull the missing models and show the status of every model
+
+--offline never pulls models and fails when one is missing.
+
+Every command except serve accepts --json to print a machine-readable result.
+Run without a command to open the interactive menu.
+`
+
+// parseInterspersed parses flags that may appear before, between or after
+// positional arguments and returns the positional arguments in order.
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			if err == flag.ErrHelp {
+				return nil, err
+			}
+			return nil, usageError(err.Error())
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// splitList splits a comma separated flag value, dropping empty entries.
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// writeJSON prints v as indented JSON.
+func writeJSON(w io.Writer, v interface{}) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// cliCommand runs a subcommand against an initialized CodeAssistant. It
+// returns the value printed in --json mode and the text printed otherwise.
+type cliCommand func(ca *CodeAssistant, fs *flag.FlagSet, args []string) (interface{}, string, error)
+
+var cliCommands = map[string]cliCommand{
+	"index":        runIndexCommand,
+	"reindex":      runReindexCommand,
+	"retry-failed": runRetryFailedCommand,
+	"ask":          runAskCommand,
+	"review":       runReviewCommand,
+	"user":         runUserCommand,
+	"db":           runDBCommand,
+	"models":       runModelsCommand,
+}
+
+// modelFreeCommands do not talk to Ollama, so they skip pulling models
+var modelFreeCommands = map[string]bool{
+	"user": true,
+	"db":   true,
+}
+
+// runCommand executes a non-interactive subcommand and returns the exit code.
+func runCommand(config Config, args []string) int {
+	name, args := args[0], args[1:]
+
+	if name == "help" || name == "-h" || name == "--help" {
+		fmt.Print(cliUsage)
+		return exitOK
+	}
+
+	command, ok := cliCommands[name]
+	if !ok && name != "serve" {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n%s", name, cliUsage)
+		return exitUsage
+	}
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	jsonOutput := fs.Bool("json", false, "print the result as JSON")
+
+	// Everything the assistant logs goes to stderr in JSON mode so stdout
+	// only carries the result document.
+	stdout := os.Stdout
+	if hasFlag(args, "json") {
+		os.Stdout = os.Stderr
+		defer func() { os.Stdout = stdout }()
+	}
+
+	var assistant *CodeAssistant
+	var err error
+	if name == "db" {
+		// Leave the schema as it is so db status can show pending migrations
+		assistant, err = openDatabase(config)
+	} else {
+		assistant, err = NewCodeAssistant(config)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitError
+	}
+	defer assistant.Close()
+
+	if !modelFreeCommands[name] {
+		// The web server starts while missing models are pulled and shows
+		// their progress, other commands wait for them
+		if err := assistant.provisionModels(assistant.ctx, name == "serve"); err != nil {
+			fmt.Fprintf(os.Stderr, "Error getting models: %v\n", err)
+			return exitError
+		}
+	}
+
+	if name == "serve" {
+		command = func(ca *CodeAssistant, fs *flag.FlagSet, args []string) (interface{}, string, error) {
+			if _, err := parseInterspersed(fs, args); err != nil {
+				return nil, "", err
+			}
+			return nil, "", ca.Serve()
+		}
+	} else {
+		// Interrupting a command checkpoints indexing instead of killing it mid-file
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-signals
+			signal.Stop(signals)
+			assistant.stop()
+		}()
+	}
+
+	result, text, err := command(assistant, fs, args)
+	if err == flag.ErrHelp {
+		fs.SetOutput(os.Stderr)
+		fs.Usage()
+		return exitOK
+	}
+	if err != nil {
+		if _, usage := err.(usageError); usage {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			fs.SetOutput(os.Stderr)
+			fs.Usage()
+			return exitUsage
+		}
+		if *jsonOutput {
+			writeJSON(stdout, map[string]string{"error": err.Error()})
+		} else {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		}
+		return exitError
+	}
+
+	if *jsonOutput {
+		if err := writeJSON(stdout, result); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing output: %v\n", err)
+			return exitError
+		}
+	} else if text != "" {
+		fmt.Fprintln(stdout, text)
+	}
+	return exitOK
+}
+
+// usageError marks errors caused by invalid command line arguments.
+type usageError string
+
+func (e usageError) Error() string { return string(e) }
+
+// hasFlag reports whether a boolean flag is set in args before they are parsed.
+func hasFlag(args []string, name string) bool {
+	for _, arg := range args {
+		if arg == "--" {
+			return false
+		}
+		if arg == "-"+name || arg == "--"+name || arg == "-"+name+"=true" || arg == "--"+name+"=true" {
+			return true
+		}
+	}
+	return false
+}
+
+func runIndexCommand(ca *CodeAssistant, fs *flag.FlagSet, args []string) (interface{}, string, error) {
+	projectName := fs.String("name", "", "project name")
+	path := fs.String("path", "", "path to the codebase")
+	excludeDirs := fs.String("exclude-dir", "", "folders to exclude (comma separated)")
+	excludeFiles := fs.String("exclude-file", "", "files to exclude (comma separated)")
+	resume := fs.Bool("resume", false, "continue the last unfinished run with the saved settings")
+	if _, err := parseInterspersed(fs, args); err != nil {
+		return nil, "", err
+	}
+	if *resume && *projectName == "" {
+		return nil, "", usageError("--name is required")
+	}
+	if !*resume && (*projectName == "" || *path == "") {
+		return nil, "", usageError("--name and --path are required")
+	}
+
+	var result IndexResult
+	var err error
+	if *resume {
+		result, err = ca.reindexProject(nil, *projectName, ReindexOptions{Resume: true})
+	} else {
+		result, err = ca.indexProject(ca.ctx, nil, *projectName, *path, splitList(*excludeDirs), splitList(*excludeFiles))
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return result, fmt.Sprintf("Indexed %s: %d processed, %d failed, %d removed, %d renamed", result.Project, result.Processed, result.Failed, result.Removed, result.Renamed), nil
+}
+
+func runReindexCommand(ca *CodeAssistant, fs *flag.FlagSet, args []string) (interface{}, string, error) {
+	var opts ReindexOptions
+	fs.BoolVar(&opts.Wipe, "wipe", false, "delete generated docs and hashes before reindexing")
+	fs.BoolVar(&opts.Resume, "resume", false, "continue the last unfinished run")
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(positional) != 1 {
+		return nil, "", usageError("reindex expects exactly one project name")
+	}
+	if opts.Wipe && opts.Resume {
+		return nil, "", usageError("--wipe and --resume cannot be combined")
+	}
+
+	result, err := ca.reindexProject(nil, positional[0], opts)
+	if err != nil {
+		return nil, "", err
+	}
+	return result, fmt.Sprintf("Reindexed %s: %d processed, %d failed, %d removed, %d renamed", result.Project, result.Processed, result.Failed, result.Removed, result.Renamed), nil
+}
+
+func runRetryFailedCommand(ca *CodeAssistant, fs *flag.FlagSet, args []string) (interface{}, string, error) {
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(positional) != 1 {
+		return nil, "", usageError("retry-failed expects exactly one project name")
+	}
+
+	result, err := ca.reindexProject(nil, positional[0], ReindexOptions{RetryFailed: true})
+	if err != nil {
+		return nil, "", err
+	}
+	return result, fmt.Sprintf("Retried %d failed files of %s: %d processed, %d still failing", result.Files, result.Project, result.Processed, result.Failed), nil
+}
+
+func runAskCommand(ca *CodeAssistant, fs *flag.FlagSet, args []string) (interface{}, string, error) {
+	sessionID := fs.String("session", "", "chat session to continue")
+	var retrieval RetrievalConfig
+	fs.IntVar(&retrieval.TopK, "top-k", 0, "number of docs to retrieve")
+	fs.Func("min-similarity", "drop docs scoring below this (0 to 1)", func(value string) error {
+		minSimilarity, err := strconv.ParseFloat(value, 32)
+		if err != nil {
+			return err
+		}
+		retrieval.MinSimilarity = ptr(float32(minSimilarity))
+		return nil
+	})
+	fs.IntVar(&retrieval.ContextTokens, "context-tokens", 0, "token budget for retrieved docs")
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(positional) < 2 {
+		return nil, "", usageError("ask expects a project name and a question")
+	}
+	projectName := positional[0]
+	query := strings.Join(positional[1:], " ")
+
+	session, err := ca.openChatSession(ca.ctx, projectName, *sessionID, query)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Stream the answer straight to stdout unless it is wrapped in JSON
+	var onToken func(string) error
+	if !hasFlag(args, "json") {
+		onToken = func(token string) error {
+			_, err := fmt.Print(token)
+			return err
+		}
+	}
+
+	answer, sources, err := ca.askInSession(ca.ctx, &session, query, retrieval, onToken)
+	if onToken != nil {
+		fmt.Println()
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if !hasFlag(args, "json") {
+		fmt.Fprintf(os.Stderr, "Session: %s\n", session.ID)
+	}
+	result := AskResult{
+		Project:   projectName,
+		SessionID: session.ID,
+		Query:     query,
+		Answer:    answer,
+		Sources:   sources,
+	}
+	if onToken != nil {
+		return result, "", nil
+	}
+	return result, answer, nil
+}
+
+func runReviewCommand(ca *CodeAssistant, fs *flag.FlagSet, args []string) (interface{}, string, error) {
+	commit := fs.String("commit", "HEAD", "commit to review")
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(positional) != 1 {
+		return nil, "", usageError("review expects exactly one project name")
+	}
+	projectName := positional[0]
+
+	projectConfig, err := ca.loadProjectConfig(projectName)
+	if err != nil {
+		return nil, "", fmt.Errorf("error loading project config: %v", err)
+	}
+	if projectConfig.ProjectPath == "" {
+		return nil, "", fmt.Errorf("project %s has no saved codebase path", projectName)
+	}
+
+	review, err := ca.reviewCommitHash(ca.ctx, projectConfig.ProjectPath, *commit)
+	if err != nil {
+		return nil, "", err
+	}
+	result := ReviewResult{
+		Project: projectName,
+		Commit:  *commit,
+		Review:  review,
+	}
+	return result, review, nil
+}
+
+func runUserCommand(ca *CodeAssistant, fs *flag.FlagSet, args []string) (interface{}, string, error) {
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(positional) == 0 {
+		return nil, "", usageError("user expects add, delete or list")
+	}
+
+	switch action := positional[0]; {
+	case action == "list" && len(positional) == 1:
+		users, err := ca.userRoles("")
+		if err != nil {
+			return nil, "", err
+		}
+		lines := []string{}
+		for _, user := range users {
+			roles := []string{}
+			for project, role := range user.Roles {
+				roles = append(roles, project+":"+role)
+			}
+			sort.Strings(roles)
+			lines = append(lines, strings.TrimSpace(user.Username+" "+strings.Join(roles, " ")))
+		}
+		return users, strings.Join(lines, "\n"), nil
+	case action == "add" && len(positional) == 2:
+		password, err := readPassword(os.Stdin)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to read password: %v", err)
+		}
+		if err := ca.createUser(positional[1], password); err != nil {
+			return nil, "", err
+		}
+		return map[string]string{"username": positional[1]}, fmt.Sprintf("Saved user %s", positional[1]), nil
+	case action == "delete" && len(positional) == 2:
+		if err := ca.deleteUser(positional[1]); err != nil {
+			return nil, "", err
+		}
+		return map[string]string{"username": positional[1]}, fmt.Sprintf("Deleted user %s", positional[1]), nil
+	case action == "grant" && len(positional) == 4:
+		role, err := parseRole(positional[3])
+		if err != nil {
+			return nil, "", usageError(err.Error())
+		}
+		if err := ca.setRole(positional[1], positional[2], role); err != nil {
+			return nil, "", err
+		}
+		result := map[string]string{"username": positional[1], "project": positional[2], "role": role.String()}
+		return result, fmt.Sprintf("%s is now %s of %s", positional[1], role, positional[2]), nil
+	case action == "revoke" && len(positional) == 3:
+		if err := ca.removeRole(positional[1], positional[2]); err != nil {
+			return nil, "", err
+		}
+		return map[string]string{"username": positional[1], "project": positional[2]}, fmt.Sprintf("Revoked %s's role on %s", positional[1], positional[2]), nil
+	default:
+		return nil, "", usageError("usage: user add NAME | delete NAME | list | grant NAME PROJECT ROLE | revoke NAME PROJECT")
+	}
+}
+
+func runDBCommand(ca *CodeAssistant, fs *flag.FlagSet, args []string) (interface{}, string, error) {
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(positional) != 1 {
+		return nil, "", usageError("usage: db migrate | status")
+	}
+
+	switch positional[0] {
+	case "migrate":
+		applied, err := ca.migrateDatabase()
+		if err != nil {
+			return nil, "", err
+		}
+		if len(applied) == 0 {
+			return applied, "Schema is up to date", nil
+		}
+		return applied, fmt.Sprintf("Applied %d migrations, schema is at version %d", len(applied), applied[len(applied)-1].Version), nil
+	case "status":
+		status, err := ca.migrationStatus()
+		if err != nil {
+			return nil, "", err
+		}
+		lines := []string{}
+		for _, m := range status {
+			state := "pending"
+			if m.AppliedAt != nil {
+				state = "applied " + m.AppliedAt.Format(time.RFC3339)
+			}
+			lines = append(lines, fmt.Sprintf("%4d  %-28s %s", m.Version, m.Name, state))
+		}
+		return status, strings.Join(lines, "\n"), nil
+	default:
+		return nil, "", usageError("usage: db migrate | status")
+	}
+}
+
+// runModelsCommand lists the configured models. runCommand has already
+// provisioned them and printed their report.
+func runModelsCommand(ca *CodeAssistant, fs *flag.FlagSet, args []string) (interface{}, string, error) {
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(positional) != 0 {
+		return nil, "", usageError("usage: models")
+	}
+	return ca.models.list(), "", nil
+}
+
+// readPassword prompts for a password without echo on a terminal and reads
+// the first line of input otherwise, so scripts can pipe it in.
+func readPassword(in *os.File) (string, error) {
+	if term.IsTerminal(int(in.Fd())) {
+		fmt.Fprint(os.Stderr, "Password: ")
+		password, err := term.ReadPassword(int(in.Fd()))
+		fmt.Fprintln(os.Stderr)
+		return string(password), err
+	}
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fixtureFiles are the files of testdata/fixture that get indexed, node_modules
+// and the README are skipped
+var fixtureFiles = []string{"calc/calc.go", "scripts/report.py", "server/login.go"}
+
+// fakeBackends serve the fake provider to the assistant in process and
+// through the Ollama API, so both code paths are covered.
+var fakeBackends = []struct {
+	name  string
+	setup func(t *testing.T, ca *CodeAssistant, provider *fakeProvider)
+}{
+	{"in-process", func(t *testing.T, ca *CodeAssistant, provider *fakeProvider) { useFakeProvider(ca, provider) }},
+	{"ollama-api", func(t *testing.T, ca *CodeAssistant, provider *fakeProvider) { newFakeOllama(t, ca, provider) }},
+}
+
+// newFakeAssistant returns a test assistant whose models are served by a new
+// fake provider.
+func newFakeAssistant(t *testing.T, setup func(t *testing.T, ca *CodeAssistant, provider *fakeProvider)) (*CodeAssistant, *fakeProvider) {
+	t.Helper()
+	ca := newTestAssistant(t)
+	ca.config.DocumentationModel = "test-doc"
+	ca.config.CodeChatModel = "test-chat"
+	provider := newFakeProvider()
+	setup(t, ca, provider)
+	ca.models = newModelTracker(ca.config) // With the models and host set above
+	return ca, provider
+}
+
+// copyFixture copies the fixture codebase to a temporary directory.
+func copyFixture(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	err := filepath.WalkDir("testdata/fixture", func(path string, entry os.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		relPath, err := filepath.Rel("testdata/fixture", path)
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dir, relPath)
+		if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+			return err
+		}
+		return os.WriteFile(target, data, 0644)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// indexFixture indexes codebase as the "fixture" project and checks that
+// every file was processed.
+func indexFixture(t *testing.T, ca *CodeAssistant, codebase string) IndexResult {
+	t.Helper()
+	result, err := ca.indexProject(context.Background(), nil, "fixture", codebase, nil, nil)
+	if err != nil {
+		t.Fatalf("indexing: %v", err)
+	}
+	if result.Failed != 0 {
+		failed, _ := ca.failedFiles("fixture")
+		t.Fatalf("%d files failed: %+v", result.Failed, failed)
+	}
+	return result
+}
+
+// checkIndexed checks the docs, hashes and vector collection of the fixture
+// project against the files of codebase.
+func checkIndexed(t *testing.T, ca *CodeAssistant, codebase string, relPaths []string) {
+	t.Helper()
+	hashes, err := ca.projectFileHashes("fixture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hashes) != len(relPaths) {
+		t.Errorf("got hashes of %d files, want %d: %v", len(hashes), len(relPaths), hashes)
+	}
+
+	chunks := 0
+	for _, relPath := range relPaths {
+		file := filepath.Join(codebase, relPath)
+		code, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		doc, err := os.ReadFile(filepath.Join(ca.config.DocsDir, "fixture", relPath+".txt"))
+		if err != nil {
+			t.Errorf("doc of %s: %v", relPath, err)
+			continue
+		}
+		if want := "File: " + relPath + "\n" + fakeDoc(string(code)); string(doc) != want {
+			t.Errorf("doc of %s is %q, want %q", relPath, doc, want)
+		}
+		chunks += len(chunkDocuments(relPath, file, string(doc)))
+
+		contentHash, err := calculateSHA256Hash(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := ca.currentFileHash(contentHash); hashes[relPath] != want {
+			t.Errorf("hash of %s is %+v, want %+v", relPath, hashes[relPath], want)
+		}
+	}
+
+	collec, _ := ca.projectCollection(ca.vectorDB.Load(), "fixture")
+	if collec == nil {
+		t.Fatal("the project has no vector collection")
+	}
+	if collec.Count() != chunks {
+		t.Errorf("collection has %d chunks, want %d", collec.Count(), chunks)
+	}
+	model, dimension, found, err := ca.collectionInfo("fixture")
+	if err != nil || !found || model != ca.config.EmbeddingModel || dimension != hashEmbeddingDimension {
+		t.Errorf("collection recorded as %s with dimension %d (found %v, %v), want %s with %d",
+			model, dimension, found, err, ca.config.EmbeddingModel, hashEmbeddingDimension)
+	}
+}
+
+func TestIndexFixture(t *testing.T) {
+	for _, backend := range fakeBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			ca, provider := newFakeAssistant(t, backend.setup)
+			codebase := copyFixture(t)
+
+			result := indexFixture(t, ca, codebase)
+			if result.Files != len(fixtureFiles) || result.Processed != len(fixtureFiles) {
+				t.Errorf("got %d files and %d processed, want %d", result.Files, result.Processed, len(fixtureFiles))
+			}
+			checkIndexed(t, ca, codebase, fixtureFiles)
+			if _, err := os.Stat(filepath.Join(ca.config.DocsDir, "fixture", "node_modules")); !os.IsNotExist(err) {
+				t.Errorf("node_modules was documented")
+			}
+			config, err := ca.loadProjectConfig("fixture")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.Status != ProjectIndexed || config.TotalIndexedFiles != len(fixtureFiles) || len(config.PendingFiles) != 0 {
+				t.Errorf("project is %s with %d files indexed and %v pending", config.Status, config.TotalIndexedFiles, config.PendingFiles)
+			}
+
+			// Unchanged files are not documented again
+			requests := provider.docRequests()
+			if result := indexFixture(t, ca, codebase); result.Processed != 0 {
+				t.Errorf("reindexing unchanged files processed %d", result.Processed)
+			}
+			if provider.docRequests() != requests {
+				t.Errorf("unchanged files were documented again")
+			}
+
+			// Only the changed file is documented, the renamed one keeps its
+			// doc and the deleted one's doc and vectors are removed
+			calc := filepath.Join(codebase, "calc", "calc.go")
+			code, err := os.ReadFile(calc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			code = append(code, "\n// Multiply returns the product of a and b.\nfunc Multiply(a, b int) int {\n\treturn a * b\n}\n"...)
+			if err := os.WriteFile(calc, code, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Rename(filepath.Join(codebase, "scripts", "report.py"), filepath.Join(codebase, "scripts", "usage_report.py")); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Remove(filepath.Join(codebase, "server", "login.go")); err != nil {
+				t.Fatal(err)
+			}
+
+			result = indexFixture(t, ca, codebase)
+			if result.Processed != 1 || result.Renamed != 1 || result.Removed != 1 {
+				t.Errorf("got %d processed, %d renamed and %d removed, want 1 of each", result.Processed, result.Renamed, result.Removed)
+			}
+			if provider.docRequests() != requests+1 {
+				t.Errorf("got %d doc requests, want %d", provider.docRequests()-requests, 1)
+			}
+			checkIndexed(t, ca, codebase, []string{"calc/calc.go", "scripts/usage_report.py"})
+			if _, err := os.Stat(filepath.Join(ca.config.DocsDir, "fixture", "server", "login.go.txt")); !os.IsNotExist(err) {
+				t.Errorf("doc of the deleted file was kept")
+			}
+		})
+	}
+}
+
+func TestAskFixture(t *testing.T) {
+	for _, backend := range fakeBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			ca, provider := newFakeAssistant(t, backend.setup)
+			codebase := copyFixture(t)
+			indexFixture(t, ca, codebase)
+
+			provider.reply("Where is the Divide function defined?", "Divide is defined in calc/calc.go.")
+			provider.reply("Who calls it?", "Nothing in the fixture calls Divide.")
+			session, err := ca.createChatSession("fixture", "", "Divide")
+			if err != nil {
+				t.Fatal(err)
+			}
+			retrieval := RetrievalConfig{MinSimilarity: ptr(float32(0))}
+
+			var streamed strings.Builder
+			answer, sources, err := ca.askInSession(context.Background(), &session, "Where is the Divide function defined?", retrieval, func(token string) error {
+				streamed.WriteString(token)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if answer != "Divide is defined in calc/calc.go." || streamed.String() != answer {
+				t.Errorf("got answer %q, streamed %q", answer, streamed.String())
+			}
+			if len(sources) == 0 || sources[0].FilePath != filepath.Join(codebase, "calc", "calc.go") {
+				t.Errorf("got sources %+v, want calc/calc.go first", sources)
+			}
+			req := provider.lastRequest(t)
+			prompt := req.Messages[len(req.Messages)-1].Content
+			if req.Model != ca.config.CodeChatModel || req.ContextWindow != fakeContextLength {
+				t.Errorf("asked %s with a context window of %d", req.Model, req.ContextWindow)
+			}
+			if !strings.Contains(prompt, "function Divide is defined in this file.") || !strings.Contains(prompt, "Where is the Divide function defined?") {
+				t.Errorf("prompt lacks the retrieved doc or the question:\n%s", prompt)
+			}
+
+			// A follow-up is sent with the conversation so far
+			answer, _, err = ca.askInSession(context.Background(), &session, "Who calls it?", retrieval, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if answer != "Nothing in the fixture calls Divide." {
+				t.Errorf("got answer %q to the follow-up", answer)
+			}
+			req = provider.lastRequest(t)
+			if len(req.Messages) != 3 || req.Messages[0].Content != "Where is the Divide function defined?" || req.Messages[1].Content != "Divide is defined in calc/calc.go." {
+				t.Errorf("follow-up was sent with messages %+v", req.Messages)
+			}
+			messages, err := ca.chatMessages(session.ID, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(messages) != 4 {
+				t.Errorf("session has %d messages, want 4", len(messages))
+			}
+		})
+	}
+}
+
+// git runs git in repo and fails the test on error.
+func git(t *testing.T, repo string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", append([]string{"-C", repo, "-c", "user.name=Test", "-c", "user.email=test@example.com"}, args...)...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func TestReviewFixtureCommit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	for _, backend := range fakeBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			ca, provider := newFakeAssistant(t, backend.setup)
+			repo := copyFixture(t)
+			git(t, repo, "init", "-q")
+			git(t, repo, "add", ".")
+			git(t, repo, "commit", "-q", "-m", "Add the fixture")
+
+			calc := filepath.Join(repo, "calc", "calc.go")
+			code, err := os.ReadFile(calc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			code = []byte(strings.Replace(string(code), "\tif b == 0 {\n\t\treturn 0, ErrDivideByZero\n\t}\n", "", 1))
+			if err := os.WriteFile(calc, code, 0644); err != nil {
+				t.Fatal(err)
+			}
+			git(t, repo, "commit", "-q", "-a", "-m", "Drop the zero check")
+
+			provider.reply("Review the following code changes", "Divide panics when b is zero.")
+			review, err := ca.reviewCommitHash(context.Background(), repo, git(t, repo, "rev-parse", "HEAD"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if review != "Divide panics when b is zero." {
+				t.Errorf("got review %q", review)
+			}
+			req := provider.lastRequest(t)
+			prompt := req.Messages[len(req.Messages)-1].Content
+			if req.Model != ca.config.DocumentationModel || !strings.Contains(prompt, "-\tif b == 0 {") {
+				t.Errorf("%s was asked to review a prompt without the diff:\n%s", req.Model, prompt)
+			}
+
+			// The review stops with the caller's context
+			canceled, cancel := context.WithCancel(context.Background())
+			cancel()
+			if _, err := ca.reviewCommitHash(canceled, repo, "HEAD"); !errors.Is(err, context.Canceled) {
+				t.Errorf("got %v for a canceled review, want canceled", err)
+			}
+
+			// Git's own explanation is part of the error
+			if _, err := getCommitLog(filepath.Join(repo, "missing"), 5); err == nil || !strings.Contains(err.Error(), "cannot change to") {
+				t.Errorf("got %v for a missing repository, want git's message", err)
+			}
+		})
+	}
+}
+
+func TestRetryFailedFixture(t *testing.T) {
+	ca, provider := newFakeAssistant(t, fakeBackends[0].setup)
+	codebase := copyFixture(t)
+
+	provider.fail("func HandleLogin", errors.New("model crashed"))
+	result, err := ca.indexProject(context.Background(), nil, "fixture", codebase, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Failed != 1 || result.Processed != 2 {
+		t.Errorf("got %d failed and %d processed, want 1 and 2", result.Failed, result.Processed)
+	}
+	failed, err := ca.failedFiles("fixture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 1 || failed[0].Path != "server/login.go" || failed[0].Stage != StageDocument || !strings.Contains(failed[0].Error, "model crashed") {
+		t.Fatalf("got failed files %+v", failed)
+	}
+	checkIndexed(t, ca, codebase, []string{"calc/calc.go", "scripts/report.py"})
+
+	provider.clearScript()
+	result, err = ca.reindexProject(nil, "fixture", ReindexOptions{RetryFailed: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Files != 1 || result.Processed != 1 {
+		t.Errorf("retry visited %d files and processed %d, want 1 and 1", result.Files, result.Processed)
+	}
+	if failed, _ := ca.failedFiles("fixture"); len(failed) != 0 {
+		t.Errorf("files still failing after the retry: %+v", failed)
+	}
+	checkIndexed(t, ca, codebase, fixtureFiles)
+}
+
+func TestIndexFixtureRetriesBusyOllama(t *testing.T) {
+	// The first two calls fail, the retries succeed before the breaker opens
+	ca, _ := newFakeAssistant(t, func(t *testing.T, ca *CodeAssistant, provider *fakeProvider) {
+		newFakeOllama(t, ca, provider).failNext(2)
+	})
+	codebase := copyFixture(t)
+	indexFixture(t, ca, codebase)
+	checkIndexed(t, ca, codebase, fixtureFiles)
+	if status := ca.llmBreaker.status(); status.State != BreakerClosed || status.Failures != 0 {
+		t.Errorf("breaker is %s with %d failures", status.State, status.Failures)
+	}
+}
+
+func TestIndexRunsShareLLMLimit(t *testing.T) {
+	ca, provider := newFakeAssistant(t, fakeBackends[0].setup)
+	provider.delay = 20 * time.Millisecond
+
+	var runs sync.WaitGroup
+	for _, name := range []string{"fixture", "fixture-copy"} {
+		codebase := copyFixture(t)
+		runs.Add(1)
+		go func() {
+			defer runs.Done()
+			if _, err := ca.indexProject(context.Background(), nil, name, codebase, nil, nil); err != nil {
+				t.Errorf("indexing %s: %v", name, err)
+			}
+		}()
+	}
+	runs.Wait()
+	if n := provider.concurrency(); n != 1 {
+		t.Errorf("%d documentation requests ran at once, want max_llm_requests 1 across runs", n)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/ollama/ollama/api"
+	"github.com/philippgille/chromem-go"
+)
+
+const (
+	// embedBatchSize is how many chunks are embedded per request
+	embedBatchSize = 16
+	// hashEmbeddingDimension is the length of the hash embedder's vectors
+	hashEmbeddingDimension = 256
+)
+
+// EmbeddingProvider turns doc chunks and questions into vectors.
+type EmbeddingProvider interface {
+	// Embed returns the embedding of each text with model, in order.
+	Embed(ctx context.Context, model string, texts []string) ([][]float32, error)
+}
+
+// embeddingProvider returns the provider configured for the embedding model.
+func (ca *CodeAssistant) embeddingProvider() (EmbeddingProvider, error) {
+	model := ca.config.EmbeddingModel
+	if provider, ok := ca.providers[model].(EmbeddingProvider); ok {
+		return provider, nil
+	}
+	config := ca.config.ModelProviders[model]
+	switch config.Type {
+	case "", ProviderOllama:
+		return ca.newOllamaProvider(config)
+	case ProviderOpenAI:
+		return newOpenAIProvider(model, config)
+	case ProviderHash:
+		return hashEmbedder{}, nil
+	default:
+		return nil, fmt.Errorf("model %s has unknown provider type %q", model, config.Type)
+	}
+}
+
+func (p *ollamaProvider) Embed(ctx context.Context, model string, texts []string) ([][]float32, error) {
+	resp, err := p.client.Embed(ctx, &api.EmbedRequest{Model: model, Input: texts})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Embeddings, nil
+}
+
+func (p *openAIProvider) Embed(ctx context.Context, model string, texts []string) ([][]float32, error) {
+	resp, err := p.do(ctx, http.MethodPost, "/embeddings", map[string]interface{}{
+		"model": model,
+		"input": texts,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Data []struct {
+			Index     int       `json:"index"`
+			Embedding []float32 `json:"embedding"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("invalid embeddings response: %v", err)
+	}
+	sort.Slice(result.Data, func(i, j int) bool { return result.Data[i].Index < result.Data[j].Index })
+	embeddings := make([][]float32, len(result.Data))
+	for i, data := range result.Data {
+		embeddings[i] = data.Embedding
+	}
+	return embeddings, nil
+}
+
+// hashEmbedder embeds text without a model by hashing its words into a fixed
+// number of buckets. Texts sharing words are similar, which is enough for
+// tests and for searching by identifiers without a model server.
+type hashEmbedder struct{}
+
+func (hashEmbedder) Embed(ctx context.Context, model string, texts []string) ([][]float32, error) {
+	embeddings := make([][]float32, len(texts))
+	for i, text := range texts {
+		embedding := make([]float32, hashEmbeddingDimension)
+		words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+		})
+		for _, word := range words {
+			h := fnv.New32a()
+			h.Write([]byte(word))
+			sum := h.Sum32()
+			// The top bit picks the sign so unrelated words cancel out
+			if sum&(1<<31) != 0 {
+				embedding[sum%hashEmbeddingDimension]--
+			} else {
+				embedding[sum%hashEmbeddingDimension]++
+			}
+		}
+		if len(words) == 0 {
+			embedding[0] = 1
+		}
+		embeddings[i] = embedding
+	}
+	return embeddings, nil
+}
+
+// normalizeEmbedding scales v to unit length, as the vector store compares
+// embeddings by their dot product.
+func normalizeEmbedding(v []float32) []float32 {
+	var sum float64
+	for _, x := range v {
+		sum += float64(x) * float64(x)
+	}
+	if sum == 0 {
+		return v
+	}
+	norm := float32(math.Sqrt(sum))
+	for i := range v {
+		v[i] /= norm
+	}
+	return v
+}
+
+// embedTexts embeds texts in one request with callLLM and checks that every
+// text got a normalized embedding of the same dimension.
+func (ca *CodeAssistant) embedTexts(ctx context.Context, texts []string) ([][]float32, error) {
+	provider, err := ca.embeddingProvider()
+	if err != nil {
+		return nil, err
+	}
+	var embeddings [][]float32
+	err = ca.callLLM(ctx, func(ctx context.Context) error {
+		var err error
+		embeddings, err = provider.Embed(ctx, ca.config.EmbeddingModel, texts)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to embed with %s: %w", ca.config.EmbeddingModel, err)
+	}
+	if len(embeddings) != len(texts) {
+		return nil, fmt.Errorf("%s returned %d embeddings for %d texts", ca.config.EmbeddingModel, len(embeddings), len(texts))
+	}
+	for i, embedding := range embeddings {
+		if len(embedding) == 0 || len(embedding) != len(embeddings[0]) {
+			return nil, fmt.Errorf("%s returned embeddings of different dimensions", ca.config.EmbeddingModel)
+		}
+		embeddings[i] = normalizeEmbedding(embedding)
+	}
+	return embeddings, nil
+}
+
+// embedDocuments sets the embedding of each document, embedBatchSize
+// documents per request. Each request takes an LLM request slot.
+func (ca *CodeAssistant) embedDocuments(ctx context.Context, docs []chromem.Document) error {
+	for start := 0; start < len(docs); start += embedBatchSize {
+		batch := docs[start:min(start+embedBatchSize, len(docs))]
+		texts := make([]string, len(batch))
+		for i, doc := range batch {
+			texts[i] = doc.Content
+		}
+
+		release, err := ca.throttle.acquire(ctx)
+		if err != nil {
+			return err
+		}
+		embeddings, err := ca.embedTexts(ctx, texts)
+		release()
+		if err != nil {
+			return err
+		}
+		for i := range batch {
+			batch[i].Embedding = embeddings[i]
+		}
+	}
+	return nil
+}
+
+// embeddingFunc returns the function chromem uses to embed questions.
+func (ca *CodeAssistant) embeddingFunc() chromem.EmbeddingFunc {
+	return func(ctx context.Context, text string) ([]float32, error) {
+		embeddings, err := ca.embedTexts(ctx, []string{text})
+		if err != nil {
+			return nil, err
+		}
+		return embeddings[0], nil
+	}
+}
+
+// collectionInfo returns the embedding model and dimension the project's
+// collection was built with. found is false for collections built before
+// they were recorded.
+func (ca *CodeAssistant) collectionInfo(projectName string) (model string, dimension int, found bool, err error) {
+	err = ca.db.QueryRow("SELECT embedding_model, dimension FROM vector_collections WHERE project = ?", projectName).Scan(&model, &dimension)
+	if err == sql.ErrNoRows {
+		return "", 0, false, nil
+	}
+	return model, dimension, err == nil, err
+}
+
+// collectionName returns the name of the project's current collection.
+func (ca *CodeAssistant) collectionName(projectName string) (string, error) {
+	var name string
+	err := ca.db.QueryRow("SELECT collection FROM vector_collections WHERE project = ?", projectName).Scan(&name)
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+	if name == "" {
+		return projectName, nil
+	}
+	return name, nil
+}
+
+// recordCollection stores the name, embedding model and dimension of a
+// project's collection. Recording a new name swaps that collection in.
+func (ca *CodeAssistant) recordCollection(projectName, collection string, dimension int) error {
+	_, err := ca.db.Exec(`INSERT INTO vector_collections (project, collection, embedding_model, dimension, created_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(project) DO UPDATE SET collection = excluded.collection, embedding_model = excluded.embedding_model, dimension = excluded.dimension, created_at = excluded.created_at`,
+		projectName, collection, ca.config.EmbeddingModel, dimension, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to record vector collection: %v", err)
+	}
+	return nil
+}
+
+// embeddingModelChanged reports whether the project's collection was built
+// with another embedding model than the configured one.
+func (ca *CodeAssistant) embeddingModelChanged(projectName string) (bool, error) {
+	model, _, found, err := ca.collectionInfo(projectName)
+	return found && model != ca.config.EmbeddingModel, err
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// FailureStage is the step of indexing a file that failed
+type FailureStage string
+
+const (
+	StageHash     FailureStage = "hash"     // Hashing the file or reading its stored hash
+	StageRead     FailureStage = "read"     // Reading the file or creating its doc folder
+	StageDocument FailureStage = "document" // Generating the doc with the documentation model
+	StageWrite    FailureStage = "write"    // Writing the doc
+	StageRecord   FailureStage = "record"   // Saving the file's hash
+)
+
+// FailedFile is a file that could not be indexed, as of its last attempt.
+type FailedFile struct {
+	Path     string       `json:"path"` // Relative to the codebase
+	Stage    FailureStage `json:"stage"`
+	Error    string       `json:"error"`
+	Attempts int          `json:"attempts"`
+	FailedAt time.Time    `json:"failed_at"`
+}
+
+// recordFailure stores why a file failed, counting the attempt.
+func (ca *CodeAssistant) recordFailure(projectName, relPath string, stage FailureStage, reason error) error {
+	_, err := ca.db.Exec(`INSERT INTO failed_files (project, rel_path, stage, error, attempts, failed_at) VALUES (?, ?, ?, ?, 1, ?)
+		ON CONFLICT(project, rel_path) DO UPDATE SET stage = excluded.stage, error = excluded.error,
+			attempts = attempts + 1, failed_at = excluded.failed_at`,
+		projectName, relPath, stage, reason.Error(), time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to record failure of %s: %v", relPath, err)
+	}
+	return nil
+}
+
+// clearFailure forgets a file's failure once it is indexed or gone.
+func (ca *CodeAssistant) clearFailure(projectName, relPath string) error {
+	_, err := ca.db.Exec("DELETE FROM failed_files WHERE project = ? AND rel_path = ?", projectName, relPath)
+	return err
+}
+
+// failedFiles lists a project's failed files by path.
+func (ca *CodeAssistant) failedFiles(projectName string) ([]FailedFile, error) {
+	rows, err := ca.db.Query("SELECT rel_path, stage, error, attempts, failed_at FROM failed_files WHERE project = ? ORDER BY rel_path", projectName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	failed := []FailedFile{}
+	for rows.Next() {
+		var file FailedFile
+		if err := rows.Scan(&file.Path, &file.Stage, &file.Error, &file.Attempts, &file.FailedAt); err != nil {
+			return nil, err
+		}
+		failed = append(failed, file)
+	}
+	return failed, rows.Err()
+}
+
+// countFailedFiles returns how many of a project's files are failing.
+func (ca *CodeAssistant) countFailedFiles(projectName string) (int, error) {
+	var count int
+	err := ca.db.QueryRow("SELECT COUNT(*) FROM failed_files WHERE project = ?", projectName).Scan(&count)
+	return count, err
+}
+
+// pruneFailures forgets the failures of files that are no longer part of the
+// codebase. current holds the paths of the files that are.
+func (ca *CodeAssistant) pruneFailures(projectName string, current map[string]bool) error {
+	failed, err := ca.failedFiles(projectName)
+	if err != nil {
+		return err
+	}
+	for _, file := range failed {
+		if !current[file.Path] {
+			if err := ca.clearFailure(projectName, file.Path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+// fakeContextLength is the context length the fake models report
+const fakeContextLength = 6144
+
+// fakeDefinition matches the functions a fake doc lists: Go funcs and
+// methods, and Python defs
+var fakeDefinition = regexp.MustCompile(`(?m)^\s*(?:func(?:\s+\([^)]*\))?|def)\s+(\w+)`)
+
+// fakeReply is a scripted answer of the fake provider
+type fakeReply struct {
+	match string // Text the last message of the request contains
+	reply string
+	err   error
+}
+
+// fakeProvider is an in-process ChatProvider and EmbeddingProvider. Chat
+// answers with the first scripted reply whose match appears in the last
+// message; other documentation prompts get a doc listing the functions of the
+// code. Embeddings come from hashEmbedder, so texts sharing words are
+// similar. Every chat request is recorded.
+type fakeProvider struct {
+	mu          sync.Mutex
+	script      []fakeReply
+	chats       []ChatRequest
+	delay       time.Duration // How long each chat request takes
+	inFlight    int
+	maxInFlight int // Most chat requests answered at once
+}
+
+func newFakeProvider() *fakeProvider {
+	return &fakeProvider{}
+}
+
+// reply scripts the answer to requests whose last message contains match.
+func (p *fakeProvider) reply(match, reply string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.script = append(p.script, fakeReply{match: match, reply: reply})
+}
+
+// fail scripts requests whose last message contains match to fail with err.
+func (p *fakeProvider) fail(match string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.script = append(p.script, fakeReply{match: match, err: err})
+}
+
+// clearScript forgets the scripted replies.
+func (p *fakeProvider) clearScript() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.script = nil
+}
+
+// requests returns the chat requests received so far.
+func (p *fakeProvider) requests() []ChatRequest {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]ChatRequest(nil), p.chats...)
+}
+
+// lastRequest returns the last chat request received.
+func (p *fakeProvider) lastRequest(t *testing.T) ChatRequest {
+	t.Helper()
+	requests := p.requests()
+	if len(requests) == 0 {
+		t.Fatal("no chat request was sent")
+	}
+	return requests[len(requests)-1]
+}
+
+// docRequests counts the documentation requests received so far.
+func (p *fakeProvider) docRequests() int {
+	n := 0
+	for _, req := range p.requests() {
+		if isDocPrompt(req) {
+			n++
+		}
+	}
+	return n
+}
+
+// isDocPrompt reports whether req asks to document a source file.
+func isDocPrompt(req ChatRequest) bool {
+	last := req.Messages[len(req.Messages)-1].Content
+	return strings.Contains(last, "Generate comments and documentation") && !strings.Contains(last, "Review the following code changes")
+}
+
+// fakeDoc is the doc the fake provider writes for code.
+func fakeDoc(code string) string {
+	var doc strings.Builder
+	doc.WriteString("Documentation\n")
+	for _, match := range fakeDefinition.FindAllStringSubmatch(code, -1) {
+		fmt.Fprintf(&doc, "function %s is defined in this file.\n", match[1])
+	}
+	return doc.String()
+}
+
+// answer records req and returns its reply.
+func (p *fakeProvider) answer(req ChatRequest) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.chats = append(p.chats, req)
+	last := req.Messages[len(req.Messages)-1].Content
+	for _, scripted := range p.script {
+		if strings.Contains(last, scripted.match) {
+			return scripted.reply, scripted.err
+		}
+	}
+	if isDocPrompt(req) {
+		return fakeDoc(last), nil
+	}
+	return "", fmt.Errorf("no scripted reply for %q", last)
+}
+
+// concurrency returns the most chat requests answered at once so far.
+func (p *fakeProvider) concurrency() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.maxInFlight
+}
+
+// Chat streams the reply a word at a time.
+func (p *fakeProvider) Chat(ctx context.Context, req ChatRequest, onToken func(string) error) error {
+	p.mu.Lock()
+	p.inFlight++
+	p.maxInFlight = max(p.maxInFlight, p.inFlight)
+	delay := p.delay
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		p.inFlight--
+		p.mu.Unlock()
+	}()
+	if err := sleepContext(ctx, delay); err != nil {
+		return err
+	}
+
+	reply, err := p.answer(req)
+	if err != nil {
+		return err
+	}
+	for _, token := range strings.SplitAfter(reply, " ") {
+		if err := onToken(token); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *fakeProvider) ContextLength(ctx context.Context, model string) (int, error) {
+	return fakeContextLength, nil
+}
+
+func (p *fakeProvider) Embed(ctx context.Context, model string, texts []string) ([][]float32, error) {
+	return hashEmbedder{}.Embed(ctx, model, texts)
+}
+
+// useFakeProvider serves every model of the assistant with provider in process.
+func useFakeProvider(ca *CodeAssistant, provider *fakeProvider) {
+	for _, model := range []string{ca.config.DocumentationModel, ca.config.CodeChatModel, ca.config.EmbeddingModel} {
+		ca.setProvider(model, provider)
+	}
+}
+
+// fakeOllama is an httptest stand-in for the Ollama API that serves the
+// replies and embeddings of a fake provider.
+type fakeOllama struct {
+	*httptest.Server
+	provider *fakeProvider
+
+	mu       sync.Mutex
+	failures int      // Requests left to fail with 503
+	models   []string // Models the server has
+	pulled   []string // Models pulled through the API
+}
+
+// newFakeOllama starts an Ollama stand-in for provider and points the
+// assistant at it.
+func newFakeOllama(t *testing.T, ca *CodeAssistant, provider *fakeProvider) *fakeOllama {
+	t.Helper()
+	ollama := &fakeOllama{provider: provider}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/chat", ollama.chat)
+	mux.HandleFunc("POST /api/embed", ollama.embed)
+	mux.HandleFunc("POST /api/show", ollama.show)
+	mux.HandleFunc("GET /api/tags", ollama.tags)
+	mux.HandleFunc("POST /api/pull", ollama.pull)
+	ollama.Server = httptest.NewServer(ollama.unavailable(mux))
+	t.Cleanup(ollama.Close)
+	ca.config.OllamaHost = ollama.URL
+	return ollama
+}
+
+// failNext makes the next n requests fail as if Ollama were overloaded.
+func (o *fakeOllama) failNext(n int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.failures = n
+}
+
+// addModels makes models available on the server, as if they were pulled.
+func (o *fakeOllama) addModels(models ...string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.models = append(o.models, models...)
+}
+
+// pulls returns the models pulled through the API so far.
+func (o *fakeOllama) pulls() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]string(nil), o.pulled...)
+}
+
+// unavailable answers 503 while requests are scripted to fail.
+func (o *fakeOllama) unavailable(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		o.mu.Lock()
+		fail := o.failures > 0
+		if fail {
+			o.failures--
+		}
+		o.mu.Unlock()
+		if fail {
+			writeOllamaError(w, http.StatusServiceUnavailable, "server busy")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeOllamaError answers with an error the way Ollama does.
+func writeOllamaError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
+// chat streams the reply as newline-delimited JSON.
+func (o *fakeOllama) chat(w http.ResponseWriter, r *http.Request) {
+	var chatReq api.ChatRequest
+	if err := json.NewDecoder(r.Body).Decode(&chatReq); err != nil {
+		writeOllamaError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	req := ChatRequest{Model: chatReq.Model}
+	for _, message := range chatReq.Messages {
+		req.Messages = append(req.Messages, Message{Role: message.Role, Content: message.Content})
+	}
+	if numCtx, ok := chatReq.Options["num_ctx"].(float64); ok {
+		req.ContextWindow = int(numCtx)
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	encoder := json.NewEncoder(w)
+	err := o.provider.Chat(r.Context(), req, func(token string) error {
+		return encoder.Encode(api.ChatResponse{Model: req.Model, Message: api.Message{Role: "assistant", Content: token}})
+	})
+	if err != nil {
+		writeOllamaError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	encoder.Encode(api.ChatResponse{Model: req.Model, Message: api.Message{Role: "assistant"}, Done: true})
+}
+
+func (o *fakeOllama) embed(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Model string   `json:"model"`
+		Input []string `json:"input"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeOllamaError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	embeddings, err := o.provider.Embed(r.Context(), req.Model, req.Input)
+	if err != nil {
+		writeOllamaError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(api.EmbedResponse{Model: req.Model, Embeddings: embeddings})
+}
+
+func (o *fakeOllama) show(w http.ResponseWriter, r *http.Request) {
+	var req api.ShowRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeOllamaError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	length, _ := o.provider.ContextLength(r.Context(), req.Model)
+	json.NewEncoder(w).Encode(api.ShowResponse{ModelInfo: map[string]any{"fake.context_length": length}})
+}
+
+func (o *fakeOllama) tags(w http.ResponseWriter, r *http.Request) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	list := api.ListResponse{Models: []api.ListModelResponse{}}
+	for _, model := range o.models {
+		list.Models = append(list.Models, api.ListModelResponse{Name: model, Model: model, Size: 1 << 20})
+	}
+	json.NewEncoder(w).Encode(list)
+}
+
+// pull streams the progress of downloading a single layer.
+func (o *fakeOllama) pull(w http.ResponseWriter, r *http.Request) {
+	var req api.PullRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeOllamaError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	encoder := json.NewEncoder(w)
+	encoder.Encode(api.ProgressResponse{Status: "pulling manifest"})
+	for completed := int64(0); completed <= 1<<20; completed += 1 << 19 {
+		encoder.Encode(api.ProgressResponse{Status: "pulling layer", Digest: "sha256:fake", Total: 1 << 20, Completed: completed})
+	}
+	encoder.Encode(api.ProgressResponse{Status: "success"})
+	o.addModels(req.Model)
+	o.mu.Lock()
+	o.pulled = append(o.pulled, req.Model)
+	o.mu.Unlock()
+}
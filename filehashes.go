@@ -0,0 +1,122 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FileHash records what a file's generated doc was made from. The doc is
+// regenerated when any of it changes.
+type FileHash struct {
+	ContentHash   string // SHA-256 of the source file
+	Model         string // Documentation model that wrote the doc
+	PromptVersion int    // docPromptVersion of the prompt used
+}
+
+// currentFileHash returns the FileHash a doc generated now would have.
+func (ca *CodeAssistant) currentFileHash(contentHash string) FileHash {
+	return FileHash{ContentHash: contentHash, Model: ca.config.DocumentationModel, PromptVersion: docPromptVersion}
+}
+
+// projectFileHashes returns the stored hashes of a project's files, keyed by
+// path relative to the codebase.
+func (ca *CodeAssistant) projectFileHashes(projectName string) (map[string]FileHash, error) {
+	rows, err := ca.db.Query("SELECT rel_path, content_hash, model, prompt_version FROM file_hashes WHERE project = ?", projectName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hashes := map[string]FileHash{}
+	for rows.Next() {
+		var relPath string
+		var hash FileHash
+		if err := rows.Scan(&relPath, &hash.ContentHash, &hash.Model, &hash.PromptVersion); err != nil {
+			return nil, err
+		}
+		hashes[relPath] = hash
+	}
+	return hashes, rows.Err()
+}
+
+// migrateFileHashes converts the file_hashes table keyed by absolute path with
+// an MD5 hash to one keyed by project and relative path. Old rows are assigned
+// to every project whose codebase contains the file. Files that are unchanged
+// since they were documented are assumed to have been documented with the
+// current model and prompt; the others are left with an empty hash so they
+// are documented again.
+func (ca *CodeAssistant) migrateFileHashes(tx *sql.Tx) error {
+	if _, err := tx.Exec("ALTER TABLE file_hashes RENAME TO file_hashes_legacy"); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`
+		CREATE TABLE file_hashes (
+			project TEXT NOT NULL,
+			rel_path TEXT NOT NULL,
+			content_hash TEXT NOT NULL,
+			model TEXT NOT NULL,
+			prompt_version INTEGER NOT NULL,
+			PRIMARY KEY (project, rel_path)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	oldHashes := map[string]string{}
+	rows, err := tx.Query("SELECT file_path, hash FROM file_hashes_legacy")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var filePath, hash string
+		if err := rows.Scan(&filePath, &hash); err != nil {
+			rows.Close()
+			return err
+		}
+		oldHashes[filePath] = hash
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(ca.config.DocsDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	migrated := 0
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		projectConfig, err := readProjectConfigFile(ca.config.DocsDir, entry.Name())
+		if err != nil || projectConfig.ProjectPath == "" {
+			continue
+		}
+		for filePath, oldHash := range oldHashes {
+			relPath, err := filepath.Rel(projectConfig.ProjectPath, filePath)
+			if err != nil || strings.HasPrefix(relPath, "..") {
+				continue
+			}
+			hash := FileHash{Model: ca.config.DocumentationModel, PromptVersion: docPromptVersion}
+			if md5Hash, err := calculateMD5Hash(filePath); err == nil && md5Hash == oldHash {
+				hash.ContentHash, _ = calculateSHA256Hash(filePath)
+			}
+			if _, err := tx.Exec("INSERT OR REPLACE INTO file_hashes (project, rel_path, content_hash, model, prompt_version) VALUES (?, ?, ?, ?, ?)",
+				entry.Name(), relPath, hash.ContentHash, hash.Model, hash.PromptVersion); err != nil {
+				return err
+			}
+			migrated++
+		}
+	}
+
+	if _, err := tx.Exec("DROP TABLE file_hashes_legacy"); err != nil {
+		return err
+	}
+	fmt.Printf("Migrated %d file hashes to per-project tracking\n", migrated)
+	return nil
+}
@@ -2,28 +2,70 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"os/exec"
+	"strconv"
 	"strings"
+	"time"
 )
 
-func getGitDiff(repoPath string, commitHash string) (string, error) {
-	cmd := exec.Command("git", "-C", repoPath, "diff", commitHash+"^!", "--unified=0")
-	var out bytes.Buffer
+// runGit runs git in repoPath and returns its output. A failure includes what
+// git printed to stderr, which says why.
+func runGit(repoPath string, args ...string) (string, error) {
+	cmd := exec.Command("git", append([]string{"-C", repoPath}, args...)...)
+	var out, stderr bytes.Buffer
 	cmd.Stdout = &out
-	err := cmd.Run()
-	if err != nil {
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%v: %s", err, msg)
+		}
 		return "", err
 	}
 	return out.String(), nil
 }
 
+func getGitDiff(repoPath string, commitHash string) (string, error) {
+	return runGit(repoPath, "diff", commitHash+"^!", "--unified=0")
+}
+
 func getCommitList(repoPath string) ([]string, error) {
-	cmd := exec.Command("git", "-C", repoPath, "log", "--pretty=format:%H", "-n", "20")
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	err := cmd.Run()
+	out, err := runGit(repoPath, "log", "--pretty=format:%H", "-n", "20")
 	if err != nil {
 		return nil, err
 	}
-	return strings.Split(out.String(), "\n"), nil
+	return strings.Split(out, "\n"), nil
+}
+
+// CommitInfo describes a single commit in a repository's history
+type CommitInfo struct {
+	Hash    string    `json:"hash"`
+	Author  string    `json:"author"`
+	Date    time.Time `json:"date"`
+	Subject string    `json:"subject"`
+}
+
+// getCommitLog returns the last n commits of the repository with their metadata.
+func getCommitLog(repoPath string, n int) ([]CommitInfo, error) {
+	// Fields are separated by the ASCII unit separator, which never appears in them
+	out, err := runGit(repoPath, "log", "--pretty=format:%H%x1f%an%x1f%aI%x1f%s", "-n", strconv.Itoa(n))
+	if err != nil {
+		return nil, err
+	}
+
+	commits := []CommitInfo{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(line, "\x1f")
+		if len(fields) != 4 {
+			continue
+		}
+		date, _ := time.Parse(time.RFC3339, fields[2])
+		commits = append(commits, CommitInfo{
+			Hash:    fields[0],
+			Author:  fields[1],
+			Date:    date,
+			Subject: fields[3],
+		})
+	}
+	return commits, nil
 }
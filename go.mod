@@ -10,15 +10,18 @@ require (
 	github.com/schollz/progressbar/v3 v3.18.0
 )
 
-require github.com/mattn/go-sqlite3 v1.14.17
+require (
+	github.com/fatih/color v1.18.0
+	github.com/mattn/go-sqlite3 v1.14.17
+	github.com/ssimunic/gosensors v0.0.0-20170414000417-e7ab9a4e799b
+	golang.org/x/crypto v0.35.0
+	golang.org/x/term v0.29.0
+)
 
 require (
-	github.com/fatih/color v1.18.0 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/mitchellh/colorstring v0.0.0-20190213212951-d06e56a500db // indirect
 	github.com/rivo/uniseg v0.4.7 // indirect
-	github.com/ssimunic/gosensors v0.0.0-20170414000417-e7ab9a4e799b // indirect
 	golang.org/x/sys v0.30.0 // indirect
-	golang.org/x/term v0.29.0 // indirect
 )
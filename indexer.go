@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/philippgille/chromem-go"
+)
+
+const (
+	defaultIndexWorkers   = 4
+	defaultMaxLLMRequests = 1
+
+	// Without temperature sensors, indexing pauses for coolDownPeriod after a
+	// file takes longer than maxFileProcessTime to document or after
+	// maxTotalProcessTime of work. The total also applies with sensors.
+	maxFileProcessTime  = 30 * time.Second
+	maxTotalProcessTime = 5 * time.Minute
+	coolDownPeriod      = 60 * time.Second
+)
+
+// IndexingConfig controls how many files an index run processes at once.
+// Workers hash, read and document files in parallel, but only MaxLLMRequests
+// documentation and embedding requests are sent to Ollama at a time, across
+// all index runs.
+type IndexingConfig struct {
+	Workers        int `json:"workers,omitempty"`          // Files processed in parallel by each run
+	MaxLLMRequests int `json:"max_llm_requests,omitempty"` // Ollama requests in flight at once
+}
+
+// withDefaults returns c with its unset fields set to the defaults.
+func (c IndexingConfig) withDefaults() IndexingConfig {
+	if c.Workers <= 0 {
+		c.Workers = defaultIndexWorkers
+	}
+	if c.MaxLLMRequests <= 0 {
+		c.MaxLLMRequests = defaultMaxLLMRequests
+	}
+	return c
+}
+
+// indexThrottle paces the Ollama requests of every index run in the process.
+// It bounds how many are in flight and pauses every worker while the
+// hardware cools down or Ollama is unavailable. Workers call wait before each
+// LLM request and check after documenting a file; during a cooldown no new
+// request starts while the ones in flight finish. Each worker stops waiting
+// when its own run is stopped, without cutting the pause short for others.
+type indexThrottle struct {
+	slots        chan struct{} // Holds a token per Ollama request in flight
+	mu           sync.Mutex
+	monitor      *TemperatureMonitor // Created when the first run starts
+	busySince    time.Time           // Start of the work counted against maxTotalProcessTime
+	lastCoolDown time.Time
+	cooling      chan struct{} // Closed when the cooldown in progress ends, nil without one
+	outage       bool          // Whether the jobs were told that Ollama is unavailable
+	outageWaits  int           // Workers waiting for Ollama to come back
+
+	runsMu sync.Mutex
+	runs   int           // Index runs in progress
+	jobs   map[*Job]bool // Jobs of the runs, told about cooldowns and outages
+}
+
+// newIndexThrottle creates the throttle shared by the index runs.
+func newIndexThrottle(config IndexingConfig) *indexThrottle {
+	return &indexThrottle{
+		slots: make(chan struct{}, config.withDefaults().MaxLLMRequests),
+		jobs:  map[*Job]bool{},
+	}
+}
+
+// start registers an index run, whose job hears about cooldowns and outages,
+// and returns the func that ends it. The first run sets up temperature
+// monitoring; remote Ollama hosts use the time-based fallback, as their
+// temperature cannot be read.
+func (t *indexThrottle) start(job *Job, ollamaHost string) func() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.monitor == nil {
+		isLocalHost := strings.Contains(ollamaHost, "localhost")
+		// Initialize with safe defaults (80°C critical, 65°C safe)
+		t.monitor = NewTemperatureMonitor(80, 65, !isLocalHost)
+	}
+
+	t.runsMu.Lock()
+	defer t.runsMu.Unlock()
+	if t.runs == 0 {
+		t.busySince = time.Now() // Time without runs is not work
+	}
+	t.runs++
+	if job != nil {
+		t.jobs[job] = true
+	}
+	return func() {
+		t.runsMu.Lock()
+		defer t.runsMu.Unlock()
+		t.runs--
+		delete(t.jobs, job)
+	}
+}
+
+// report calls fn with the job of every run.
+func (t *indexThrottle) report(fn func(job *Job)) {
+	t.runsMu.Lock()
+	defer t.runsMu.Unlock()
+	for job := range t.jobs {
+		fn(job)
+	}
+}
+
+// acquire waits for a free LLM request slot, or until ctx is done. The
+// returned func frees the slot.
+func (t *indexThrottle) acquire(ctx context.Context) (func(), error) {
+	select {
+	case t.slots <- struct{}{}:
+		return func() { <-t.slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// wait blocks while a cooldown is in progress, or until ctx is done.
+func (t *indexThrottle) wait(ctx context.Context) error {
+	t.mu.Lock()
+	cooling := t.cooling
+	t.mu.Unlock()
+	if cooling == nil {
+		return ctx.Err()
+	}
+	select {
+	case <-cooling:
+		return ctx.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// check cools down when the hardware is hot, or with the fallback when the
+// file that started documenting at started took too long or the runs have
+// been busy for too long. Files that started before the last cooldown ended
+// do not trigger another one. The cooldown runs on its own, so stopping the
+// run that triggered it only stops that run's wait.
+func (t *indexThrottle) check(ctx context.Context, started time.Time) {
+	t.mu.Lock()
+	if t.cooling != nil {
+		t.mu.Unlock()
+		t.wait(ctx)
+		return
+	}
+
+	var coolDown func()
+	fileProcessTime := time.Since(started)
+	totalProcessTime := time.Since(t.busySince)
+	slowFile := t.monitor.useFallback && fileProcessTime > maxFileProcessTime && started.After(t.lastCoolDown)
+	if slowFile || totalProcessTime > maxTotalProcessTime {
+		fmt.Printf("\nTriggering cooldown period (file: %.1fs, total: %.1fm)...\n",
+			fileProcessTime.Seconds(), totalProcessTime.Minutes())
+		coolDown = func() {
+			t.report(func(job *Job) { job.cooldown(true, 0, "fallback") })
+			time.Sleep(coolDownPeriod)
+			t.report(func(job *Job) { job.cooldown(false, 0, "fallback") })
+		}
+	} else if temp, source, _ := t.monitor.getTemperature(); temp >= t.monitor.criticalTemp {
+		// Wait for the hardware to cool when the sensors report a critical temperature
+		color.Yellow("\n🚨 %s temperature critical (%d°C)", strings.ToUpper(source), temp)
+		coolDown = func() {
+			t.report(func(job *Job) { job.cooldown(true, temp, source) })
+			if err := t.monitor.CoolDown(); err != nil {
+				color.Red("❌ Cooling failed: %v", err)
+			}
+			temp, source, _ := t.monitor.getTemperature()
+			t.report(func(job *Job) { job.cooldown(false, temp, source) })
+		}
+	}
+	if coolDown == nil {
+		t.mu.Unlock()
+		return
+	}
+
+	cooling := make(chan struct{})
+	t.cooling = cooling
+	t.mu.Unlock()
+	go func() {
+		coolDown()
+		t.mu.Lock()
+		t.lastCoolDown = time.Now()
+		t.busySince = t.lastCoolDown
+		t.cooling = nil
+		t.mu.Unlock()
+		close(cooling)
+	}()
+	t.wait(ctx)
+}
+
+// waitForLLM blocks while the circuit breaker is open, or until ctx is done.
+// The first worker to wait reports the pause to the jobs, and the first to
+// see Ollama back reports that it recovered.
+func (t *indexThrottle) waitForLLM(ctx context.Context, breaker *circuitBreaker) error {
+	if breaker.allow() == nil {
+		return ctx.Err()
+	}
+	t.mu.Lock()
+	if !t.outage {
+		t.outage = true
+		reason := breaker.status().LastError
+		t.report(func(job *Job) { job.llmUnavailable(true, reason) })
+	}
+	t.outageWaits++
+	t.mu.Unlock()
+
+	err := breaker.wait(ctx)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.outageWaits--
+	if err == nil && t.outage {
+		t.report(func(job *Job) { job.llmUnavailable(false, "") })
+	}
+	if err == nil || t.outageWaits == 0 {
+		// Without waiters left, the next outage is reported again
+		t.outage = false
+	}
+	return err
+}
+
+// fileResult is what a worker reports about one file of an index run.
+type fileResult struct {
+	file     string
+	relPath  string
+	hash     FileHash
+	changed  bool               // The file's doc is missing or out of date
+	canceled bool               // The run stopped before the file was documented
+	err      error              // The file could not be documented
+	stage    FailureStage       // The step that failed
+	chunks   []chromem.Document // Embedded chunks of the new doc, nil if they are left to syncVectorStore
+}
+
+// indexFile documents one file if it changed since its doc was generated,
+// then embeds the new doc. It only writes the doc; the caller records the
+// file's hash once the doc is accounted for.
+func (ca *CodeAssistant) indexFile(ctx context.Context, job *Job, projectName, codebasePath, file string) fileResult {
+	result := fileResult{file: file, relPath: file}
+	relPath, err := filepath.Rel(codebasePath, file)
+	if err != nil {
+		result.err, result.stage = fmt.Errorf("error getting relative path: %v", err), StageRead
+		return result
+	}
+	result.relPath = relPath
+	job.fileStarted(relPath)
+
+	contentHash, err := calculateSHA256Hash(file)
+	if err != nil {
+		result.err, result.stage = fmt.Errorf("error calculating hash: %v", err), StageHash
+		return result
+	}
+	// Check if the file, the documentation model or the prompt has changed
+	result.hash = ca.currentFileHash(contentHash)
+	oldHash, found, err := ca.getFileHash(projectName, relPath)
+	if err != nil {
+		result.err, result.stage = fmt.Errorf("error getting hash from DB: %v", err), StageHash
+		return result
+	}
+	if found && oldHash == result.hash {
+		return result
+	}
+	result.changed = true
+
+	docPath := filepath.Join(ca.config.DocsDir, projectName, relPath+".txt")
+	if err := os.MkdirAll(filepath.Dir(docPath), os.ModePerm); err != nil {
+		result.err, result.stage = fmt.Errorf("error creating directory: %v", err), StageRead
+		return result
+	}
+	code, err := ioutil.ReadFile(file)
+	if err != nil {
+		result.err, result.stage = fmt.Errorf("error reading file: %v", err), StageRead
+		return result
+	}
+
+	// A file being documented is finished when the run is stopped, so the
+	// request in flight is not canceled with ctx, but it is not retried
+	// either. While Ollama is down the file waits.
+	var comments string
+	for {
+		if err := ca.throttle.waitForLLM(ctx, ca.llmBreaker); err != nil {
+			result.canceled = true
+			return result
+		}
+		if err := ca.throttle.wait(ctx); err != nil {
+			result.canceled = true
+			return result
+		}
+		var release func()
+		if release, err = ca.throttle.acquire(ctx); err != nil {
+			result.canceled = true
+			return result
+		}
+		fmt.Printf("Processing %s\n", file)
+		started := time.Now()
+		comments, err = ca.generateComments(finishAttempts(ctx), string(code))
+		release()
+		ca.throttle.check(ctx, started)
+		if !errors.Is(err, errLLMUnavailable) {
+			break
+		}
+	}
+	if err != nil && ctx.Err() != nil {
+		result.canceled = true
+		return result
+	}
+	if err != nil {
+		result.err, result.stage = fmt.Errorf("error generating comments: %v", err), StageDocument
+		return result
+	}
+
+	doc := fmt.Sprintf("File: %s\n%s", relPath, comments)
+	if err := ioutil.WriteFile(docPath, []byte(doc), 0644); err != nil {
+		result.err, result.stage = fmt.Errorf("error writing doc file: %v", err), StageWrite
+		return result
+	}
+
+	// Embed while other files are being documented. On failure the doc stays
+	// pending and syncVectorStore embeds it again.
+	chunks := chunkDocuments(relPath, file, doc)
+	if err := ca.throttle.wait(ctx); err != nil {
+		return result
+	}
+	if err := ca.embedDocuments(ctx, chunks); err != nil {
+		fmt.Printf("Error embedding %s, it will be embedded after indexing: %v\n", relPath, err)
+		return result
+	}
+	result.chunks = chunks
+	return result
+}
+
+// indexFiles documents files with a pool of workers and hands each result to
+// record, which is only ever called from the calling goroutine so it can
+// keep counts without locking. No new file is started once ctx is done, but
+// files being documented are finished.
+func (ca *CodeAssistant) indexFiles(ctx context.Context, job *Job, projectName, codebasePath string, files []string, record func(fileResult)) {
+	defer ca.throttle.start(job, ca.config.OllamaHost)()
+	work := make(chan string)
+	results := make(chan fileResult)
+
+	go func() {
+		defer close(work)
+		for _, file := range files {
+			if ctx.Err() != nil {
+				return
+			}
+			select {
+			case work <- file:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var workers sync.WaitGroup
+	for i := 0; i < ca.config.Indexing.withDefaults().Workers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for file := range work {
+				results <- ca.indexFile(ctx, job, projectName, codebasePath, file)
+			}
+		}()
+	}
+	go func() {
+		workers.Wait()
+		close(results)
+	}()
+
+	for result := range results {
+		record(result)
+	}
+}
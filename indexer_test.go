@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// waitResult runs wait in the background and returns its result channel.
+func waitResult(wait func() error) chan error {
+	done := make(chan error, 1)
+	go func() { done <- wait() }()
+	return done
+}
+
+func TestThrottleWaitsHonourEachRun(t *testing.T) {
+	throttle := newIndexThrottle(IndexingConfig{})
+	breaker := newCircuitBreaker(LLMConfig{BreakerThreshold: 1, BreakerCooldownSeconds: 60})
+	breaker.failure(errors.New("connection refused"))
+
+	runA, stopA := context.WithCancel(context.Background())
+	defer stopA()
+	runB, stopB := context.WithCancel(context.Background())
+	outageA := waitResult(func() error { return throttle.waitForLLM(runA, breaker) })
+	outageB := waitResult(func() error { return throttle.waitForLLM(runB, breaker) })
+
+	// A cooldown is in progress too
+	throttle.mu.Lock()
+	throttle.cooling = make(chan struct{})
+	throttle.mu.Unlock()
+	coolingB := waitResult(func() error { return throttle.wait(runB) })
+
+	// Stopping run B ends its waits while run A keeps waiting
+	stopB()
+	for name, done := range map[string]chan error{"outage": outageB, "cooldown": coolingB} {
+		select {
+		case err := <-done:
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("run B's %s wait returned %v, want canceled", name, err)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("run B still waits for the %s after it was stopped", name)
+		}
+	}
+	select {
+	case err := <-outageA:
+		t.Errorf("run A stopped waiting for Ollama with %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,625 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JobStatus is the lifecycle state of a background job
+type JobStatus string
+
+const (
+	JobRunning   JobStatus = "running"
+	JobSucceeded JobStatus = "succeeded"
+	JobFailed    JobStatus = "failed"
+	JobCanceled  JobStatus = "canceled"
+)
+
+// Job event types streamed to the web UI
+const (
+	EventFileStarted       = "file_started"
+	EventFileDocumented    = "file_documented"
+	EventFileFailed        = "file_failed"
+	EventCooldownStarted   = "cooldown_started"
+	EventCooldownEnded     = "cooldown_ended"
+	EventLLMUnavailable    = "llm_unavailable"
+	EventLLMRecovered      = "llm_recovered"
+	EventEmbeddingProgress = "embedding_progress"
+	EventJobFinished       = "job_finished"
+)
+
+// maxJobEvents caps how many events a job keeps for clients that connect late
+const maxJobEvents = 1000
+
+// Finished jobs are dropped after jobRetention, and beyond the
+// maxFinishedJobs most recent ones, so a long-running server does not keep
+// every job and its events
+const (
+	jobRetention    = 24 * time.Hour
+	maxFinishedJobs = 100
+)
+
+// JobEvent is a structured progress event published while a job runs
+type JobEvent struct {
+	Seq         int       `json:"seq"`
+	Type        string    `json:"type"`
+	Time        time.Time `json:"time"`
+	File        string    `json:"file,omitempty"`
+	Reason      string    `json:"reason,omitempty"`
+	Temperature int       `json:"temperature,omitempty"` // °C, 0 when no sensor reading is available
+	Source      string    `json:"source,omitempty"`      // Temperature source (gpu, cpu or fallback)
+	Done        int       `json:"done,omitempty"`
+	Total       int       `json:"total,omitempty"`
+	Status      JobStatus `json:"status,omitempty"`
+}
+
+// Job tracks a background indexing run started from the web UI. All methods
+// are safe to call on a nil Job so the CLI can index without one.
+type Job struct {
+	mu          sync.Mutex
+	id          string
+	kind        string
+	project     string
+	status      JobStatus
+	total       int
+	done        int
+	failed      int
+	currentFile string
+	startedAt   time.Time
+	finishedAt  time.Time
+	err         string
+	result      *IndexResult
+	events      []JobEvent             // Most recent events, oldest first
+	seq         int                    // Sequence number of the last event
+	subscribers map[chan JobEvent]bool // Live event streams
+}
+
+// JobSnapshot is a point-in-time copy of a Job, safe to render or encode
+type JobSnapshot struct {
+	ID          string       `json:"id"`
+	Kind        string       `json:"kind"`
+	Project     string       `json:"project"`
+	Status      JobStatus    `json:"status"`
+	Total       int          `json:"total"`
+	Done        int          `json:"done"`
+	Failed      int          `json:"failed"`
+	CurrentFile string       `json:"current_file,omitempty"`
+	StartedAt   time.Time    `json:"started_at"`
+	FinishedAt  *time.Time   `json:"finished_at,omitempty"`
+	ETASeconds  *int         `json:"eta_seconds,omitempty"`
+	Error       string       `json:"error,omitempty"`
+	Result      *IndexResult `json:"result,omitempty"`
+}
+
+// Snapshot returns a copy of the job state with the estimated time remaining.
+func (j *Job) Snapshot() JobSnapshot {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	snapshot := JobSnapshot{
+		ID:          j.id,
+		Kind:        j.kind,
+		Project:     j.project,
+		Status:      j.status,
+		Total:       j.total,
+		Done:        j.done,
+		Failed:      j.failed,
+		CurrentFile: j.currentFile,
+		StartedAt:   j.startedAt,
+		Error:       j.err,
+		Result:      j.result,
+	}
+	if !j.finishedAt.IsZero() {
+		finishedAt := j.finishedAt
+		snapshot.FinishedAt = &finishedAt
+	}
+
+	// Estimate from the average time per finished file so far
+	completed := j.done + j.failed
+	if j.status == JobRunning && completed > 0 && j.total > completed {
+		perFile := time.Since(j.startedAt) / time.Duration(completed)
+		eta := int((perFile * time.Duration(j.total-completed)).Seconds())
+		snapshot.ETASeconds = &eta
+	}
+	return snapshot
+}
+
+// setTotal records how many files the run will visit.
+func (j *Job) setTotal(total int) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.total = total
+}
+
+// fileStarted records the file currently being processed.
+func (j *Job) fileStarted(file string) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.currentFile = file
+	j.publish(JobEvent{Type: EventFileStarted, File: file})
+}
+
+// fileSkipped counts a file that was skipped as unchanged.
+func (j *Job) fileSkipped() {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.done++
+}
+
+// fileDocumented counts a file whose docs were generated.
+func (j *Job) fileDocumented(file string) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.done++
+	j.publish(JobEvent{Type: EventFileDocumented, File: file, Done: j.done + j.failed, Total: j.total})
+}
+
+// fileFailed counts a file that could not be processed.
+func (j *Job) fileFailed(file string, reason error) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.failed++
+	j.publish(JobEvent{Type: EventFileFailed, File: file, Reason: reason.Error(), Done: j.done + j.failed, Total: j.total})
+}
+
+// cooldown reports that indexing paused (started) or resumed (!started) to let
+// the hardware cool down, with the temperature reading at that moment.
+func (j *Job) cooldown(started bool, temperature int, source string) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	event := JobEvent{Type: EventCooldownEnded, Temperature: temperature, Source: source}
+	if started {
+		event.Type = EventCooldownStarted
+	}
+	j.publish(event)
+}
+
+// llmUnavailable reports that indexing paused (paused) because Ollama is
+// down, with the last error, or resumed (!paused).
+func (j *Job) llmUnavailable(paused bool, reason string) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	event := JobEvent{Type: EventLLMRecovered}
+	if paused {
+		event = JobEvent{Type: EventLLMUnavailable, Reason: reason}
+	}
+	j.publish(event)
+}
+
+// embeddingProgress reports how many documents were added to the vector store.
+func (j *Job) embeddingProgress(done, total int) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.currentFile = ""
+	j.publish(JobEvent{Type: EventEmbeddingProgress, Done: done, Total: total})
+}
+
+// publish appends an event and fans it out to subscribers. j.mu must be held.
+func (j *Job) publish(event JobEvent) {
+	j.seq++
+	event.Seq = j.seq
+	event.Time = time.Now()
+
+	j.events = append(j.events, event)
+	if len(j.events) > maxJobEvents {
+		j.events = j.events[len(j.events)-maxJobEvents:]
+	}
+	for ch := range j.subscribers {
+		select {
+		case ch <- event:
+		default:
+			// A stalled client is dropped; it resumes from Last-Event-ID on reconnect
+			delete(j.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribe returns the kept events after afterSeq and a channel receiving
+// new ones. The channel is closed when the job finishes; it is nil when the
+// job has already finished.
+func (j *Job) subscribe(afterSeq int) ([]JobEvent, chan JobEvent) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var backlog []JobEvent
+	for _, event := range j.events {
+		if event.Seq > afterSeq {
+			backlog = append(backlog, event)
+		}
+	}
+	if j.status != JobRunning {
+		return backlog, nil
+	}
+
+	ch := make(chan JobEvent, 64)
+	if j.subscribers == nil {
+		j.subscribers = make(map[chan JobEvent]bool)
+	}
+	j.subscribers[ch] = true
+	return backlog, ch
+}
+
+// unsubscribe stops delivering events to ch.
+func (j *Job) unsubscribe(ch chan JobEvent) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.subscribers[ch] {
+		delete(j.subscribers, ch)
+		close(ch)
+	}
+}
+
+// finish marks the job as completed with the run's result or error.
+func (j *Job) finish(result IndexResult, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.finishedAt = time.Now()
+	j.currentFile = ""
+	j.result = &result
+	switch {
+	case err == context.Canceled:
+		j.status = JobCanceled
+		j.err = "canceled by shutdown"
+	case err != nil:
+		j.status = JobFailed
+		j.err = err.Error()
+	default:
+		j.status = JobSucceeded
+	}
+
+	j.publish(JobEvent{Type: EventJobFinished, Status: j.status, Reason: j.err, Done: j.done + j.failed, Total: j.total})
+	for ch := range j.subscribers {
+		close(ch)
+	}
+	j.subscribers = nil
+}
+
+// finishedTime returns when the job finished, or the zero time while it runs.
+func (j *Job) finishedTime() time.Time {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.finishedAt
+}
+
+// JobManager runs indexing jobs in the background and keeps their state
+// until they are pruned
+type JobManager struct {
+	mu          sync.Mutex
+	jobs        map[string]*Job
+	ids         []string      // Job IDs in start order
+	retention   time.Duration // How long finished jobs are kept
+	maxFinished int           // How many finished jobs are kept
+}
+
+// NewJobManager creates an empty JobManager
+func NewJobManager() *JobManager {
+	return &JobManager{jobs: make(map[string]*Job), retention: jobRetention, maxFinished: maxFinishedJobs}
+}
+
+// prune drops the finished jobs that are past the retention period or
+// beyond the most recent maxFinished. The caller holds m.mu.
+func (m *JobManager) prune() {
+	keep := make([]bool, len(m.ids))
+	finished := 0
+	for i := len(m.ids) - 1; i >= 0; i-- {
+		finishedAt := m.jobs[m.ids[i]].finishedTime()
+		if finishedAt.IsZero() {
+			keep[i] = true
+			continue
+		}
+		finished++
+		keep[i] = finished <= m.maxFinished && time.Since(finishedAt) < m.retention
+	}
+	ids := m.ids[:0]
+	for i, id := range m.ids {
+		if keep[i] {
+			ids = append(ids, id)
+		} else {
+			delete(m.jobs, id)
+		}
+	}
+	m.ids = ids
+}
+
+// Start launches run in a new goroutine and returns the job tracking it.
+func (m *JobManager) Start(kind, project string, run func(job *Job) (IndexResult, error)) *Job {
+	job := &Job{
+		id:        newJobID(),
+		kind:      kind,
+		project:   project,
+		status:    JobRunning,
+		startedAt: time.Now(),
+	}
+
+	m.mu.Lock()
+	m.prune()
+	m.jobs[job.id] = job
+	m.ids = append(m.ids, job.id)
+	m.mu.Unlock()
+
+	go func() {
+		result, err := run(job)
+		job.finish(result, err)
+	}()
+	return job
+}
+
+// Get returns the job with the given ID.
+func (m *JobManager) Get(id string) (*Job, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.jobs[id]
+	return job, ok
+}
+
+// Latest returns the most recently started job for project.
+func (m *JobManager) Latest(project string) (*Job, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := len(m.ids) - 1; i >= 0; i-- {
+		if job := m.jobs[m.ids[i]]; job.project == project {
+			return job, true
+		}
+	}
+	return nil, false
+}
+
+// List returns snapshots of all jobs, newest first.
+func (m *JobManager) List() []JobSnapshot {
+	m.mu.Lock()
+	m.prune()
+	jobs := make([]*Job, 0, len(m.ids))
+	for i := len(m.ids) - 1; i >= 0; i-- {
+		jobs = append(jobs, m.jobs[m.ids[i]])
+	}
+	m.mu.Unlock()
+
+	snapshots := make([]JobSnapshot, 0, len(jobs))
+	for _, job := range jobs {
+		snapshots = append(snapshots, job.Snapshot())
+	}
+	return snapshots
+}
+
+// newJobID returns a random 16 character hex ID.
+func newJobID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return time.Now().Format("20060102150405.000000000")
+	}
+	return hex.EncodeToString(b)
+}
+
+// validProjectName reports whether name can be used as a project directory under DocsDir.
+func validProjectName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, `/\`)
+}
+
+// wantsJSON reports whether the client asked for a JSON response instead of a page.
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// startIndexJob indexes the codebase at path as projectName in the background.
+// The project is locked before the job starts, so a second job for it fails
+// with errProjectBusy instead of queueing.
+func (ca *CodeAssistant) startIndexJob(projectName, path string, exclude, excludeFiles []string) (*Job, error) {
+	unlock, err := ca.registry.lock(projectName, "indexing")
+	if err != nil {
+		return nil, err
+	}
+	return ca.jobs.Start("index", projectName, func(job *Job) (IndexResult, error) {
+		defer unlock()
+		return ca.indexProjectLocked(ca.ctx, job, projectName, path, exclude, excludeFiles, ReindexOptions{})
+	}), nil
+}
+
+// startReindexJob reindexes a saved project in the background, failing with
+// errProjectBusy like startIndexJob.
+func (ca *CodeAssistant) startReindexJob(projectName string, opts ReindexOptions) (*Job, error) {
+	unlock, err := ca.registry.lock(projectName, "indexing")
+	if err != nil {
+		return nil, err
+	}
+	return ca.jobs.Start("reindex", projectName, func(job *Job) (IndexResult, error) {
+		defer unlock()
+		return ca.reindexProjectLocked(job, projectName, opts)
+	}), nil
+}
+
+// jobsHandler starts indexing jobs (POST) and lists them (GET).
+func (ca *CodeAssistant) jobsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		writeJSON(w, ca.visibleJobs(r.Context(), ca.jobs.List()))
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	projectName := strings.TrimSpace(r.FormValue("project_name"))
+	if !validProjectName(projectName) {
+		http.Error(w, "A valid project name is required", http.StatusBadRequest)
+		return
+	}
+	if !ca.authorize(w, r, projectName, RoleMaintainer) {
+		return
+	}
+
+	var job *Job
+	var err error
+	switch kind := r.FormValue("kind"); kind {
+	case "", "index":
+		// Existing projects change through reindex or PATCH, so one team
+		// cannot point another's project at a different codebase
+		existing, err := ca.loadProjectConfig(projectName)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error loading project config: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if existing.ProjectName != "" {
+			http.Error(w, fmt.Sprintf("project_exists: project %s already exists, reindex it instead", projectName), http.StatusConflict)
+			return
+		}
+		path := strings.TrimSpace(r.FormValue("project_path"))
+		if info, err := os.Stat(path); err != nil || !info.IsDir() {
+			http.Error(w, fmt.Sprintf("Codebase path %q is not a readable directory", path), http.StatusBadRequest)
+			return
+		}
+		job, err = ca.startIndexJob(projectName, path, splitList(r.FormValue("exclude_folders")), splitList(r.FormValue("exclude_files")))
+	case "reindex":
+		job, err = ca.startReindexJob(projectName, ReindexOptions{
+			Wipe:   r.FormValue("wipe") == "on" || r.FormValue("wipe") == "true",
+			Resume: r.FormValue("resume") == "on" || r.FormValue("resume") == "true",
+		})
+	case "retry-failed":
+		job, err = ca.startReindexJob(projectName, ReindexOptions{RetryFailed: true})
+	default:
+		http.Error(w, fmt.Sprintf("Unknown job kind %q", kind), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	location := "/jobs/" + job.id
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", location)
+		w.WriteHeader(http.StatusAccepted)
+		writeJSON(w, job.Snapshot())
+		return
+	}
+	http.Redirect(w, r, location, http.StatusSeeOther)
+}
+
+// jobHandler serves the job status page at /jobs/{id}, its progress as JSON
+// at /jobs/{id}/status and its event stream at /jobs/{id}/events.
+func (ca *CodeAssistant) jobHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/jobs/")
+	id, view, _ := strings.Cut(id, "/")
+
+	job, ok := ca.jobs.Get(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if !ca.authorize(w, r, job.project, RoleViewer) {
+		return
+	}
+
+	switch view {
+	case "":
+	case "status":
+		w.Header().Set("Content-Type", "application/json")
+		writeJSON(w, job.Snapshot())
+		return
+	case "events":
+		ca.jobEventsHandler(w, r, job)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	ca.renderTemplate(w, r, "templates/job.html", job.Snapshot())
+}
+
+// sseHeartbeat keeps idle event streams open through proxies
+const sseHeartbeat = 15 * time.Second
+
+// jobEventsHandler streams a job's events as Server-Sent Events. Clients that
+// reconnect with Last-Event-ID only receive the events they missed.
+func (ca *CodeAssistant) jobEventsHandler(w http.ResponseWriter, r *http.Request, job *Job) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	lastSeq, _ := strconv.Atoi(r.Header.Get("Last-Event-ID"))
+	backlog, events := job.subscribe(lastSeq)
+	if events != nil {
+		defer job.unsubscribe(events)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	for _, event := range backlog {
+		writeSSEEvent(w, event)
+	}
+	flusher.Flush()
+	if events == nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case event, open := <-events:
+			if !open {
+				return
+			}
+			writeSSEEvent(w, event)
+			flusher.Flush()
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-ca.ctx.Done():
+			return
+		}
+	}
+}
+
+// writeSSEEvent writes a single event in text/event-stream format.
+func writeSSEEvent(w io.Writer, event JobEvent) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Seq, event.Type, data)
+}
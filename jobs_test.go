@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// finishedJob starts a job on m that finishes right away and waits for it.
+func finishedJob(t *testing.T, m *JobManager) *Job {
+	t.Helper()
+	job := m.Start("index", "demo", func(job *Job) (IndexResult, error) { return IndexResult{}, nil })
+	for job.finishedTime().IsZero() {
+		time.Sleep(time.Millisecond)
+	}
+	return job
+}
+
+func TestJobManagerPrunesFinishedJobs(t *testing.T) {
+	m := NewJobManager()
+	m.maxFinished = 2
+	release := make(chan struct{})
+	running := m.Start("index", "demo", func(job *Job) (IndexResult, error) {
+		<-release
+		return IndexResult{}, nil
+	})
+	defer close(release)
+	oldest := finishedJob(t, m)
+	finishedJob(t, m)
+	finishedJob(t, m)
+
+	// Only the 2 most recent finished jobs are kept, and running ones
+	if jobs := m.List(); len(jobs) != 3 {
+		t.Errorf("kept %d jobs, want 3", len(jobs))
+	}
+	if _, ok := m.Get(oldest.id); ok {
+		t.Errorf("the oldest finished job was kept")
+	}
+	if _, ok := m.Get(running.id); !ok {
+		t.Errorf("the running job was dropped")
+	}
+
+	// Finished jobs are dropped after the retention period
+	m.retention = 0
+	if jobs := m.List(); len(jobs) != 1 || jobs[0].ID != running.id {
+		t.Errorf("got %+v, want only the running job", jobs)
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// RunStatus is the state of an index run in the journal
+type RunStatus string
+
+const (
+	RunRunning     RunStatus = "running"     // In progress, or the process died during it
+	RunInterrupted RunStatus = "interrupted" // Stopped cleanly, can be resumed
+	RunCompleted   RunStatus = "completed"
+	RunFailed      RunStatus = "failed"
+)
+
+// FileState is the state of one file in an index run
+type FileState string
+
+const (
+	FilePending    FileState = "pending"    // Not processed yet
+	FileSkipped    FileState = "skipped"    // Unchanged since its doc was generated
+	FileDocumented FileState = "documented" // Doc written, not embedded yet
+	FileEmbedded   FileState = "embedded"   // Doc searchable in the vector store
+	FileFailed     FileState = "failed"
+)
+
+// A process indexing a project renews its lease every indexLeaseHeartbeat;
+// one not renewed for indexLeaseTimeout is taken to belong to a process that
+// died.
+const (
+	indexLeaseHeartbeat = 10 * time.Second
+	indexLeaseTimeout   = 45 * time.Second
+)
+
+// leaseProject claims the project's index lease in the database, failing
+// with errProjectBusy while another process holds it, and renews it until
+// the returned func releases it. The caller holds the project's lock, which
+// keeps runs of this process apart.
+func (ca *CodeAssistant) leaseProject(projectName string) (func(), error) {
+	owner, err := randomToken(8)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := ca.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var heartbeat time.Time
+	err = tx.QueryRow("SELECT heartbeat_at FROM index_leases WHERE project = ?", projectName).Scan(&heartbeat)
+	if err == nil && time.Since(heartbeat) < indexLeaseTimeout {
+		return nil, fmt.Errorf("%w: %s is being indexed by another process", errProjectBusy, projectName)
+	} else if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	_, err = tx.Exec(`INSERT INTO index_leases (project, owner, heartbeat_at) VALUES (?, ?, ?)
+		ON CONFLICT(project) DO UPDATE SET owner = excluded.owner, heartbeat_at = excluded.heartbeat_at`,
+		projectName, owner, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to claim index lease: %v", err)
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(indexLeaseHeartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if _, err := ca.db.Exec("UPDATE index_leases SET heartbeat_at = ? WHERE project = ? AND owner = ?",
+					time.Now(), projectName, owner); err != nil {
+					fmt.Printf("Error renewing the index lease of %s: %v\n", projectName, err)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-stopped
+		if _, err := ca.db.Exec("DELETE FROM index_leases WHERE project = ? AND owner = ?", projectName, owner); err != nil {
+			fmt.Printf("Error releasing the index lease of %s: %v\n", projectName, err)
+		}
+	}, nil
+}
+
+// startIndexRun journals a new run over relPaths, all pending. The files of
+// the project's earlier runs are dropped, only the latest run can be resumed.
+func (ca *CodeAssistant) startIndexRun(projectName string, relPaths []string) (int64, error) {
+	tx, err := ca.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM index_run_files WHERE run_id IN (SELECT id FROM index_runs WHERE project = ?)", projectName); err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	res, err := tx.Exec("INSERT INTO index_runs (project, status, started_at) VALUES (?, ?, ?)", projectName, RunRunning, now)
+	if err != nil {
+		return 0, err
+	}
+	runID, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	stmt, err := tx.Prepare("INSERT INTO index_run_files (run_id, rel_path, state, updated_at) VALUES (?, ?, ?, ?)")
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+	for _, relPath := range relPaths {
+		if _, err := stmt.Exec(runID, relPath, FilePending, now); err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to start index run: %v", err)
+	}
+	return runID, nil
+}
+
+// resumableRun returns the project's latest run if it did not finish, with
+// the files it has not processed yet. A run still marked running was left by
+// a process that died, as the caller holds the project's index lease.
+func (ca *CodeAssistant) resumableRun(projectName string) (runID int64, pending []string, found bool, err error) {
+	var status RunStatus
+	err = ca.db.QueryRow("SELECT id, status FROM index_runs WHERE project = ? ORDER BY id DESC LIMIT 1", projectName).Scan(&runID, &status)
+	if err == sql.ErrNoRows || (err == nil && status != RunRunning && status != RunInterrupted) {
+		return 0, nil, false, nil
+	} else if err != nil {
+		return 0, nil, false, err
+	}
+
+	rows, err := ca.db.Query("SELECT rel_path FROM index_run_files WHERE run_id = ? AND state = ? ORDER BY rel_path", runID, FilePending)
+	if err != nil {
+		return 0, nil, false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var relPath string
+		if err := rows.Scan(&relPath); err != nil {
+			return 0, nil, false, err
+		}
+		pending = append(pending, relPath)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, nil, false, err
+	}
+	if _, err := ca.db.Exec("UPDATE index_runs SET status = ? WHERE id = ?", RunRunning, runID); err != nil {
+		return 0, nil, false, err
+	}
+	return runID, pending, true, nil
+}
+
+// unembeddedFiles returns the files the project's runs documented but did
+// not record as embedded, in case the process died before they were saved
+// as pending.
+func (ca *CodeAssistant) unembeddedFiles(projectName string) ([]string, error) {
+	rows, err := ca.db.Query(`SELECT rel_path FROM index_run_files
+		WHERE state = ? AND run_id IN (SELECT id FROM index_runs WHERE project = ?)`, FileDocumented, projectName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var relPaths []string
+	for rows.Next() {
+		var relPath string
+		if err := rows.Scan(&relPath); err != nil {
+			return nil, err
+		}
+		relPaths = append(relPaths, relPath)
+	}
+	return relPaths, rows.Err()
+}
+
+// runFileCounts returns how many files of a run were documented (embedded or
+// not), how many failed and how many the run visits in total.
+func (ca *CodeAssistant) runFileCounts(runID int64) (documented, failed, total int, err error) {
+	rows, err := ca.db.Query("SELECT state, COUNT(*) FROM index_run_files WHERE run_id = ? GROUP BY state", runID)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var state FileState
+		var count int
+		if err := rows.Scan(&state, &count); err != nil {
+			return 0, 0, 0, err
+		}
+		switch state {
+		case FileDocumented, FileEmbedded:
+			documented += count
+		case FileFailed:
+			failed += count
+		}
+		total += count
+	}
+	return documented, failed, total, rows.Err()
+}
+
+// setFileState records a file's state in a run, with the error when it failed.
+func (ca *CodeAssistant) setFileState(runID int64, relPath string, state FileState, reason error) error {
+	message := ""
+	if reason != nil {
+		message = reason.Error()
+	}
+	_, err := ca.db.Exec("UPDATE index_run_files SET state = ?, error = ?, updated_at = ? WHERE run_id = ? AND rel_path = ?",
+		state, message, time.Now(), runID, relPath)
+	return err
+}
+
+// markFilesEmbedded records that files of a run are embedded.
+func (ca *CodeAssistant) markFilesEmbedded(runID int64, relPaths []string) error {
+	tx, err := ca.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	now := time.Now()
+	for _, relPath := range relPaths {
+		if _, err := tx.Exec("UPDATE index_run_files SET state = ?, updated_at = ? WHERE run_id = ? AND rel_path = ?",
+			FileEmbedded, now, runID, relPath); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// markRunEmbedded records that every documented file of a run is embedded.
+func (ca *CodeAssistant) markRunEmbedded(runID int64) error {
+	_, err := ca.db.Exec("UPDATE index_run_files SET state = ?, updated_at = ? WHERE run_id = ? AND state = ?",
+		FileEmbedded, time.Now(), runID, FileDocumented)
+	return err
+}
+
+// finishIndexRun records how a run ended. Once a run completes, the
+// project's earlier runs are no longer needed and are dropped with their files.
+func (ca *CodeAssistant) finishIndexRun(runID int64, status RunStatus) error {
+	var finishedAt interface{}
+	if status != RunInterrupted {
+		finishedAt = time.Now()
+	}
+	tx, err := ca.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE index_runs SET status = ?, finished_at = ? WHERE id = ?", status, finishedAt, runID); err != nil {
+		return err
+	}
+	if status == RunCompleted {
+		earlier := "SELECT id FROM index_runs WHERE project = (SELECT project FROM index_runs WHERE id = ?) AND id < ?"
+		if _, err := tx.Exec("DELETE FROM index_run_files WHERE run_id IN ("+earlier+")", runID, runID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM index_runs WHERE id IN ("+earlier+")", runID, runID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+const (
+	defaultLLMTimeout             = 5 * time.Minute
+	defaultLLMMaxRetries          = 3
+	defaultBreakerThreshold       = 5
+	defaultBreakerCooldownSeconds = 30
+
+	// Backoff before the first retry, doubled for each further one
+	llmRetryBaseDelay = time.Second
+	llmRetryMaxDelay  = 30 * time.Second
+)
+
+// errLLMUnavailable is returned without calling Ollama while the circuit
+// breaker is open.
+var errLLMUnavailable = errors.New("Ollama is unavailable")
+
+// errPartialResponse marks a failure after part of a streamed answer was
+// handed to the caller, which cannot be retried without repeating it.
+var errPartialResponse = errors.New("response interrupted")
+
+// LLMConfig controls how calls to Ollama are retried. After BreakerThreshold
+// calls in a row fail because Ollama is unreachable or overloaded, the
+// circuit breaker opens: chat requests fail fast and indexing pauses until
+// BreakerCooldownSeconds have passed and a call succeeds again.
+type LLMConfig struct {
+	TimeoutSeconds         int `json:"timeout_seconds,omitempty"`          // Per attempt, including loading the model
+	MaxRetries             int `json:"max_retries,omitempty"`              // Retries of a failed call, -1 to disable
+	BreakerThreshold       int `json:"breaker_threshold,omitempty"`        // Failures in a row that open the breaker
+	BreakerCooldownSeconds int `json:"breaker_cooldown_seconds,omitempty"` // How long the breaker stays open
+}
+
+// withDefaults returns c with its unset fields set to the defaults.
+func (c LLMConfig) withDefaults() LLMConfig {
+	if c.TimeoutSeconds <= 0 {
+		c.TimeoutSeconds = int(defaultLLMTimeout / time.Second)
+	}
+	if c.MaxRetries == 0 {
+		c.MaxRetries = defaultLLMMaxRetries
+	} else if c.MaxRetries < 0 {
+		c.MaxRetries = 0
+	}
+	if c.BreakerThreshold <= 0 {
+		c.BreakerThreshold = defaultBreakerThreshold
+	}
+	if c.BreakerCooldownSeconds <= 0 {
+		c.BreakerCooldownSeconds = defaultBreakerCooldownSeconds
+	}
+	return c
+}
+
+// BreakerState is the state of the circuit breaker in front of Ollama
+type BreakerState string
+
+const (
+	BreakerClosed   BreakerState = "closed"    // Calls go through
+	BreakerOpen     BreakerState = "open"      // Ollama is down, calls fail fast
+	BreakerHalfOpen BreakerState = "half_open" // Cooldown over, the next call decides
+)
+
+// BreakerStatus is a point-in-time copy of the circuit breaker
+type BreakerStatus struct {
+	State     BreakerState `json:"state"`
+	Failures  int          `json:"failures"` // Calls failed in a row
+	LastError string       `json:"last_error,omitempty"`
+	OpenUntil *time.Time   `json:"open_until,omitempty"`
+}
+
+// circuitBreaker stops calling Ollama after too many failures in a row. It is
+// shared by every caller, so one outage pauses all index runs and chats.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	lastErr   string
+	openUntil time.Time     // Zero while closed
+	probe     chan struct{} // Closed when the half-open probe ends, nil when none is in flight
+}
+
+// newCircuitBreaker creates a closed breaker with the thresholds of config.
+func newCircuitBreaker(config LLMConfig) *circuitBreaker {
+	config = config.withDefaults()
+	return &circuitBreaker{
+		threshold: config.BreakerThreshold,
+		cooldown:  time.Duration(config.BreakerCooldownSeconds) * time.Second,
+	}
+}
+
+// status returns the breaker's current state.
+func (b *circuitBreaker) status() BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	status := BreakerStatus{State: BreakerClosed, Failures: b.failures, LastError: b.lastErr}
+	if !b.openUntil.IsZero() {
+		openUntil := b.openUntil
+		status.OpenUntil = &openUntil
+		status.State = BreakerHalfOpen
+		if time.Now().Before(openUntil) {
+			status.State = BreakerOpen
+		}
+	}
+	return status
+}
+
+// allow returns errLLMUnavailable while the breaker is open or its half-open
+// probe is still in flight.
+func (b *circuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.allowLocked()
+}
+
+func (b *circuitBreaker) allowLocked() error {
+	if time.Now().Before(b.openUntil) || b.probe != nil {
+		return fmt.Errorf("%w: %s", errLLMUnavailable, b.lastErr)
+	}
+	return nil
+}
+
+// begin admits a call, like allow. Once the cooldown is over only one call is
+// admitted, as the probe; it reports probe true and must end with success,
+// failure or abandon.
+func (b *circuitBreaker) begin() (probe bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.allowLocked(); err != nil {
+		return false, err
+	}
+	if b.openUntil.IsZero() {
+		return false, nil
+	}
+	b.probe = make(chan struct{})
+	return true, nil
+}
+
+// abandon ends a probe that got no verdict on Ollama, so another call can probe.
+func (b *circuitBreaker) abandon(probe bool) {
+	if !probe {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.endProbe()
+}
+
+func (b *circuitBreaker) endProbe() {
+	if b.probe != nil {
+		close(b.probe)
+		b.probe = nil
+	}
+}
+
+// wait blocks until the breaker lets calls through again, or ctx is done.
+func (b *circuitBreaker) wait(ctx context.Context) error {
+	for {
+		b.mu.Lock()
+		remaining := time.Until(b.openUntil)
+		probe := b.probe
+		b.mu.Unlock()
+		if remaining > 0 {
+			if err := sleepContext(ctx, remaining); err != nil {
+				return err
+			}
+			continue
+		}
+		if probe == nil {
+			return ctx.Err()
+		}
+		select {
+		case <-probe:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// success closes the breaker.
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.openUntil.IsZero() {
+		fmt.Println("Ollama is reachable again, resuming")
+	}
+	b.endProbe()
+	b.failures = 0
+	b.lastErr = ""
+	b.openUntil = time.Time{}
+}
+
+// failure counts a failed call and opens the breaker once the threshold is
+// reached. A failed call after the cooldown opens it again right away.
+func (b *circuitBreaker) failure(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.endProbe()
+	b.failures++
+	b.lastErr = err.Error()
+	if b.failures >= b.threshold && !time.Now().Before(b.openUntil) {
+		b.openUntil = time.Now().Add(b.cooldown)
+		fmt.Printf("Ollama failed %d times in a row, pausing calls for %s: %v\n", b.failures, b.cooldown, err)
+	}
+}
+
+// retryableLLMError reports whether err means the model server is
+// unreachable, restarting, overloaded or timed out, as opposed to rejecting
+// the request.
+func retryableLLMError(err error) bool {
+	retryableStatus := func(code int) bool {
+		return code >= http.StatusInternalServerError || code == http.StatusTooManyRequests
+	}
+	var statusErr api.StatusError
+	if errors.As(err, &statusErr) {
+		return retryableStatus(statusErr.StatusCode)
+	}
+	var providerErr providerStatusError
+	if errors.As(err, &providerErr) {
+		return retryableStatus(providerErr.StatusCode)
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// retryDelay returns the jittered backoff before the given retry, counted
+// from 0: between half and all of the exponentially growing delay.
+func retryDelay(retry int) time.Duration {
+	delay := min(llmRetryBaseDelay<<retry, llmRetryMaxDelay)
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// finishAttemptKey marks contexts made by finishAttempts
+type finishAttemptKey struct{}
+
+// finishAttempts returns a context for callLLM under which canceling ctx lets
+// the attempt in flight finish, for up to shutdownTimeout, instead of
+// aborting it. No further attempt is made once ctx is done.
+func finishAttempts(ctx context.Context) context.Context {
+	return context.WithValue(ctx, finishAttemptKey{}, true)
+}
+
+// attemptContext returns the context an attempt of callLLM runs under, and
+// the func that releases it.
+func attemptContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if finish, _ := ctx.Value(finishAttemptKey{}).(bool); !finish {
+		return ctx, func() {}
+	}
+	attemptCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(ctx, func() {
+		select {
+		case <-time.After(shutdownTimeout):
+			cancel()
+		case <-attemptCtx.Done():
+		}
+	})
+	return attemptCtx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// callLLM runs call through the circuit breaker, giving each attempt the
+// configured timeout and retrying transient failures with backoff. Once the
+// breaker is open it returns errLLMUnavailable, wrapped with the last error.
+func (ca *CodeAssistant) callLLM(ctx context.Context, call func(ctx context.Context) error) error {
+	config := ca.config.LLM.withDefaults()
+	timeout := time.Duration(config.TimeoutSeconds) * time.Second
+
+	var err error
+	for attempt := 0; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var probe bool
+		probe, err = ca.llmBreaker.begin()
+		if err != nil {
+			return err
+		}
+		parentCtx, release := attemptContext(ctx)
+		attemptCtx, cancel := context.WithTimeout(parentCtx, timeout)
+		err = call(attemptCtx)
+		timedOut := attemptCtx.Err() == context.DeadlineExceeded
+		cancel()
+		release()
+		if err == nil {
+			ca.llmBreaker.success()
+			return nil
+		}
+		if ctx.Err() != nil {
+			ca.llmBreaker.abandon(probe)
+			return ctx.Err()
+		}
+		if timedOut {
+			err = fmt.Errorf("no response within %s: %w", timeout, err)
+		}
+		if !retryableLLMError(err) {
+			ca.llmBreaker.abandon(probe)
+			return err
+		}
+		ca.llmBreaker.failure(err)
+		if attempt >= config.MaxRetries || errors.Is(err, errPartialResponse) || ca.llmBreaker.allow() != nil {
+			break
+		}
+		delay := retryDelay(attempt)
+		fmt.Printf("Ollama call failed, retrying in %s: %v\n", delay.Round(time.Millisecond), err)
+		if err := sleepContext(ctx, delay); err != nil {
+			return err
+		}
+	}
+	if ca.llmBreaker.allow() != nil {
+		return fmt.Errorf("%w: %v", errLLMUnavailable, err)
+	}
+	return err
+}
+
+// chat sends req to the model's provider with callLLM. A streamed answer is
+// only retried if the failed attempt had not passed anything to onToken yet.
+func (ca *CodeAssistant) chat(ctx context.Context, req ChatRequest, onToken func(string) error) error {
+	provider, err := ca.chatProvider(req.Model)
+	if err != nil {
+		return err
+	}
+	return ca.callLLM(ctx, func(ctx context.Context) error {
+		streamed := false
+		err := provider.Chat(ctx, req, func(token string) error {
+			streamed = true
+			return onToken(token)
+		})
+		if err != nil && streamed {
+			return fmt.Errorf("%w: %w", errPartialResponse, err)
+		}
+		return err
+	})
+}
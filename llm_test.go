@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testChat is a chat request the fake provider answers.
+var testChat = ChatRequest{Model: "test-chat", Messages: []Message{{Role: "user", Content: "ping"}}}
+
+func TestOllamaChatErrorStatus(t *testing.T) {
+	for _, test := range []struct {
+		status    int
+		retryable bool
+	}{
+		{http.StatusServiceUnavailable, true},
+		{http.StatusTooManyRequests, true},
+		{http.StatusNotFound, false},
+	} {
+		t.Run(fmt.Sprint(test.status), func(t *testing.T) {
+			// Ollama answers with a JSON error body, which its client returns
+			// as a plain error
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				writeOllamaError(w, test.status, "server busy")
+			}))
+			defer server.Close()
+			ca := newTestAssistant(t)
+			ca.config.OllamaHost = server.URL
+			provider, err := ca.newOllamaProvider(ProviderConfig{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = provider.Chat(context.Background(), testChat, func(string) error { return nil })
+			var statusErr providerStatusError
+			if !errors.As(err, &statusErr) || statusErr.StatusCode != test.status || statusErr.Message != "server busy" {
+				t.Fatalf("got %#v, want a %d status error", err, test.status)
+			}
+			if retryableLLMError(err) != test.retryable {
+				t.Errorf("retryable is %v, want %v", !test.retryable, test.retryable)
+			}
+		})
+	}
+}
+
+func TestChatRetriesBusyOllama(t *testing.T) {
+	var ollama *fakeOllama
+	ca, provider := newFakeAssistant(t, func(t *testing.T, ca *CodeAssistant, provider *fakeProvider) {
+		ollama = newFakeOllama(t, ca, provider)
+	})
+	provider.reply("ping", "pong")
+
+	ollama.failNext(1)
+	answer := ""
+	err := ca.chat(context.Background(), testChat, func(token string) error {
+		answer += token
+		return nil
+	})
+	if err != nil || answer != "pong" {
+		t.Fatalf("got %q, %v, want the answer after a retry", answer, err)
+	}
+
+	// Failures without retries open the breaker
+	ca.config.LLM = LLMConfig{MaxRetries: -1, BreakerThreshold: 2}
+	ca.llmBreaker = newCircuitBreaker(ca.config.LLM)
+	ollama.failNext(2)
+	for i := 0; i < 2; i++ {
+		ca.chat(context.Background(), testChat, func(string) error { return nil })
+	}
+	if status := ca.llmBreaker.status(); status.State != BreakerOpen {
+		t.Errorf("breaker is %+v after 2 busy responses, want open", status)
+	}
+}
+
+func TestOpenAIChatStreamErrorStatus(t *testing.T) {
+	for _, test := range []struct {
+		chunk     string
+		status    int
+		retryable bool
+	}{
+		{`{"error": {"message": "overloaded", "code": 503}}`, http.StatusServiceUnavailable, true},
+		{`{"error": {"message": "prompt too long", "code": 400}}`, http.StatusBadRequest, false},
+		{`{"error": {"message": "failed", "code": "server_error"}}`, http.StatusOK, false},
+	} {
+		t.Run(fmt.Sprint(test.status), func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/event-stream")
+				fmt.Fprintf(w, "data: %s\n\n", test.chunk)
+			}))
+			defer server.Close()
+			provider, err := newOpenAIProvider("test-chat", ProviderConfig{Type: ProviderOpenAI, BaseURL: server.URL})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = provider.Chat(context.Background(), testChat, func(string) error { return nil })
+			var statusErr providerStatusError
+			if !errors.As(err, &statusErr) || statusErr.StatusCode != test.status {
+				t.Fatalf("got %#v, want a %d status error", err, test.status)
+			}
+			if retryableLLMError(err) != test.retryable {
+				t.Errorf("retryable is %v, want %v", !test.retryable, test.retryable)
+			}
+		})
+	}
+}
+
+func TestCallLLMStopsRetryingWhenCanceled(t *testing.T) {
+	ca := newTestAssistant(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	attempts := 0
+	err := ca.callLLM(finishAttempts(ctx), func(attemptCtx context.Context) error {
+		attempts++
+		cancel()
+		if attemptCtx.Err() != nil {
+			t.Error("the attempt in flight was canceled")
+		}
+		return providerStatusError{StatusCode: http.StatusServiceUnavailable, Message: "server busy"}
+	})
+	if !errors.Is(err, context.Canceled) || attempts != 1 {
+		t.Errorf("got %v after %d attempts, want canceled after 1", err, attempts)
+	}
+}
+
+func TestBreakerLetsOneProbeThrough(t *testing.T) {
+	ca := newTestAssistant(t)
+	ca.config.LLM = LLMConfig{MaxRetries: -1, BreakerThreshold: 1}
+	ca.llmBreaker = newCircuitBreaker(ca.config.LLM)
+	ca.llmBreaker.failure(errors.New("connection refused"))
+	ca.llmBreaker.mu.Lock()
+	ca.llmBreaker.openUntil = time.Now().Add(-time.Second)
+	ca.llmBreaker.mu.Unlock()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	probe := waitResult(func() error {
+		return ca.callLLM(context.Background(), func(ctx context.Context) error {
+			close(started)
+			<-release
+			return nil
+		})
+	})
+	<-started
+
+	// Everyone else fails fast or waits while the probe is in flight
+	err := ca.callLLM(context.Background(), func(ctx context.Context) error {
+		t.Error("a second call went through during the probe")
+		return nil
+	})
+	if !errors.Is(err, errLLMUnavailable) {
+		t.Errorf("got %v during the probe, want errLLMUnavailable", err)
+	}
+	waiting := waitResult(func() error { return ca.llmBreaker.wait(context.Background()) })
+	select {
+	case err := <-waiting:
+		t.Errorf("wait returned %v during the probe", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The probe's success closes the breaker
+	close(release)
+	if err := <-probe; err != nil {
+		t.Fatalf("probe failed: %v", err)
+	}
+	select {
+	case err := <-waiting:
+		if err != nil {
+			t.Errorf("wait returned %v after the probe", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("wait still blocks after the probe succeeded")
+	}
+	if status := ca.llmBreaker.status(); status.State != BreakerClosed {
+		t.Errorf("breaker is %+v after the probe, want closed", status)
+	}
+}
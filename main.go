@@ -4,38 +4,51 @@ import (
 	"bufio"
 	"context"
 	"crypto/md5"
+	"crypto/sha256"
 	"database/sql"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"html/template"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/fatih/color"
-	_ "github.com/mattn/go-sqlite3" // Import SQLite driver
-	"github.com/ollama/ollama/api"
+	_ "github.com/mattn/go-sqlite3"      // Import SQLite driver
 	"github.com/philippgille/chromem-go" // Chromem in-memory vector DB
 	"github.com/schollz/progressbar/v3"
 )
 
 // Config holds the global configuration values
 type Config struct {
-	DocsDir            string `json:"docs_dir"`
-	EmbeddingModel     string `json:"embedding_model"`
-	CodeChatModel      string `json:"code_chat_model"`
-	DocumentationModel string `json:"documentation_model"`
-	OllamaHost         string `json:"ollama_host"`
-	HashDBPath         string `json:"hash_db_path"`   // Path to chromem DB directory
-	SQLiteDBPath       string `json:"sqlite_db_path"` // Path to the SQLite database
-	WebPort            string `json:"web_port"`       // Port for the web UI
-	GitBinPath         string `json:"git_bin_path"`   // Path to git binary
+	DocsDir            string          `json:"docs_dir"`
+	EmbeddingModel     string          `json:"embedding_model"`
+	CodeChatModel      string          `json:"code_chat_model"`
+	DocumentationModel string          `json:"documentation_model"`
+	OllamaHost         string          `json:"ollama_host"`
+	HashDBPath         string          `json:"hash_db_path"`   // Path to chromem DB directory
+	SQLiteDBPath       string          `json:"sqlite_db_path"` // Path to the SQLite database
+	WebPort            string          `json:"web_port"`       // Port for the web UI
+	GitBinPath         string          `json:"git_bin_path"`   // Path to git binary
+	BindAddress        string          `json:"bind_address"`   // Address the web UI listens on
+	TLSCertFile        string          `json:"tls_cert_file"`  // Serve HTTPS when both cert and key are set
+	TLSKeyFile         string          `json:"tls_key_file"`
+	Auth               AuthConfig      `json:"auth"`                      // Web UI and API authentication
+	ChatHistoryTokens  int             `json:"chat_history_tokens"`       // Earlier conversation sent with each chat question
+	Retrieval          RetrievalConfig `json:"retrieval"`                 // Docs retrieved per question, see RetrievalConfig
+	Indexing           IndexingConfig  `json:"indexing"`                  // Index worker pool, see IndexingConfig
+	LLM                LLMConfig       `json:"llm"`                       // Timeouts, retries and circuit breaker, see LLMConfig
+	ModelProviders     ProviderMap     `json:"model_providers,omitempty"` // Servers of the models not run by Ollama
+	Offline            bool            `json:"offline,omitempty"`         // Never pull models, fail when one is missing
 }
 
 // DefaultConfig returns the default global configuration
@@ -49,6 +62,10 @@ func DefaultConfig() Config {
 		HashDBPath:         "./db",           // Default vector DB path
 		SQLiteDBPath:       "file_hashes.db", // Default SQLite database path
 		WebPort:            "8080",           // Default web port
+		BindAddress:        "0.0.0.0",        // Listen on all interfaces
+		Auth: AuthConfig{
+			SessionTTLHours: 24,
+		},
 	}
 }
 
@@ -70,7 +87,7 @@ func LoadConfig(filename string) (Config, error) {
 			return config, fmt.Errorf("failed to write config file: %v", err)
 		}
 
-		fmt.Printf("Default config created at %s — continuing with defaults", filename)
+		fmt.Fprintf(os.Stderr, "Default config created at %s — continuing with defaults\n", filename)
 		// carry on with the default config
 		return config, nil
 	}
@@ -91,79 +108,99 @@ func LoadConfig(filename string) (Config, error) {
 
 // ProjectConfig holds the configuration for a specific project
 type ProjectConfig struct {
-	ProjectName       string    `json:"project_name"`
-	ProjectPath       string    `json:"project_path"`
-	ExcludeFolders    []string  `json:"exclude_folders"`
-	ExcludeFiles      []string  `json:"exclude_files"` // (optional)
-	LastUpdated       time.Time `json:"last_updated"`
-	TotalIndexedFiles int       `json:"total_indexed_files"`
-	TotalFailedFiles  int       `json:"total_failed_files"`
+	ProjectName       string          `json:"project_name"`
+	ProjectPath       string          `json:"project_path"`
+	ExcludeFolders    []string        `json:"exclude_folders"`
+	ExcludeFiles      []string        `json:"exclude_files"` // (optional)
+	Status            ProjectStatus   `json:"status"`
+	CreatedAt         time.Time       `json:"created_at"`
+	LastUpdated       time.Time       `json:"last_updated"`
+	TotalIndexedFiles int             `json:"total_indexed_files"`
+	TotalFailedFiles  int             `json:"total_failed_files"`
+	PendingEmbedding  bool            `json:"pending_embedding"`       // The whole collection must be rebuilt
+	PendingFiles      []string        `json:"pending_files,omitempty"` // Docs written but not embedded yet
+	Retrieval         RetrievalConfig `json:"retrieval"`               // Overrides the global retrieval settings
 }
 
+// CodeAssistant is shared by the web server, background jobs and the CLI, so
+// its fields are either set once at startup or safe for concurrent use.
 type CodeAssistant struct {
-	vectorDB      *chromem.DB   // Chromem in-memory vector DB
-	config        Config        // Global configuration values
-	db            *sql.DB       // SQLite database connection
-	projectConfig ProjectConfig // Project-specific config
-	projects      []string      // List of indexed projects
-}
-
-func MakeModelsAvailable(config Config) error {
-	models := []string{
-		config.EmbeddingModel,
-		config.CodeChatModel,
-		config.DocumentationModel,
-	}
-
-	for _, model := range models {
-		// Use Ollama CLI or API to download the model if missing
-		cmd := exec.Command("ollama", "pull", model)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		fmt.Printf("Ensuring model is available: %s\n", model)
-		if err := cmd.Run(); err != nil {
-			return fmt.Errorf("failed to pull model %s: %v", model, err)
-		}
-	}
-
-	return nil
+	vectorDB   atomic.Pointer[chromem.DB] // Chromem vector DB, nil once closed
+	config     Config                     // Global configuration values
+	db         *sql.DB                    // SQLite database connection
+	projects   []string                   // List of indexed projects, loaded at startup
+	ctx        context.Context            // Canceled when the assistant shuts down
+	stop       context.CancelFunc         // Cancels ctx
+	indexing   sync.WaitGroup             // Tracks indexing runs that must checkpoint before shutdown
+	indexingMu sync.Mutex                 // Orders starting a run against Close waiting for them
+	closeOnce  sync.Once                  // Runs Close once
+	closeErr   error                      // Result of the first Close
+	jobs       *JobManager                // Background indexing jobs started from the web UI
+	registry   *projectRegistry           // Per-project index and vector collection locks
+	throttle   *indexThrottle             // Paces the Ollama requests of all index runs
+	llmBreaker *circuitBreaker            // Stops calling Ollama while it is down
+	providers  map[string]interface{}     // Providers set in code by model name, see setProvider
+	models     *modelTracker              // Status of the configured models
 }
 
-func NewCodeAssistant(config Config) *CodeAssistant {
+// NewCodeAssistant opens the vector DB and the SQLite database, applying any
+// pending schema migrations.
+func NewCodeAssistant(config Config) (*CodeAssistant, error) {
 	// Initialize Chromem in-memory vector DB
 	dbChromem, err := chromem.NewPersistentDB(config.HashDBPath, false)
 	if err != nil {
-		fmt.Printf("failed to create chromem client: %v\n", err)
-		return nil
+		return nil, fmt.Errorf("failed to create chromem client: %v", err)
 	}
 
-	// Initialize SQLite database
-	db, err := sql.Open("sqlite3", config.SQLiteDBPath)
+	ca, err := openDatabase(config)
 	if err != nil {
-		log.Fatalf("Failed to open SQLite database: %v", err)
-		return nil // Or handle the error as appropriate
+		return nil, err
 	}
+	ca.vectorDB.Store(dbChromem)
 
-	// Create the file_hashes table if it doesn't exist
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS file_hashes (
-			file_path TEXT PRIMARY KEY,
-			hash TEXT
-		)
-	`)
+	if _, err := ca.migrateDatabase(); err != nil {
+		ca.db.Close()
+		return nil, fmt.Errorf("failed to migrate SQLite database: %v", err)
+	}
+	return ca, nil
+}
+
+// openDatabase returns a CodeAssistant with only the SQLite database open
+// and not migrated, for commands that manage the schema.
+func openDatabase(config Config) (*CodeAssistant, error) {
+	// Initialize SQLite database. WAL lets the web server read while an index
+	// job writes, and transactions take the write lock up front so concurrent
+	// read-modify-write updates wait for each other instead of failing.
+	dsn := config.SQLiteDBPath
+	if strings.Contains(dsn, "?") {
+		dsn += "&"
+	} else {
+		dsn += "?"
+	}
+	dsn += "_journal_mode=WAL&_busy_timeout=10000&_txlock=immediate"
+	db, err := sql.Open("sqlite3", dsn)
 	if err != nil {
-		log.Fatalf("Failed to create file_hashes table: %v", err)
-		return nil // Or handle the error as appropriate
+		return nil, fmt.Errorf("failed to open SQLite database: %v", err)
 	}
 
+	// Work started from the CLI acts as the local user. Web requests get
+	// their own contexts, which never carry this principal.
+	ctx, stop := context.WithCancel(context.WithValue(context.Background(), principalKey{}, Principal{Local: true}))
 	return &CodeAssistant{
-		vectorDB: dbChromem,
-		config:   config,
-		db:       db,
-	}
+		config:     config,
+		db:         db,
+		ctx:        ctx,
+		stop:       stop,
+		jobs:       NewJobManager(),
+		registry:   newProjectRegistry(),
+		throttle:   newIndexThrottle(config.Indexing),
+		llmBreaker: newCircuitBreaker(config.LLM),
+		models:     newModelTracker(config),
+	}, nil
 }
 
-// calculateMD5Hash calculates the MD5 hash of a file.
+// calculateMD5Hash calculates the MD5 hash of a file. It is only used to
+// migrate the hashes stored by older versions.
 func calculateMD5Hash(filePath string) (string, error) {
 	file, err := os.Open(filePath)
 	if err != nil {
@@ -179,21 +216,39 @@ func calculateMD5Hash(filePath string) (string, error) {
 	return hex.EncodeToString(hash.Sum(nil)), nil
 }
 
-// getFileHash retrieves the file hash from the database.
-func (ca *CodeAssistant) getFileHash(filePath string) (string, bool, error) {
-	var hash string
-	err := ca.db.QueryRow("SELECT hash FROM file_hashes WHERE file_path = ?", filePath).Scan(&hash)
+// calculateSHA256Hash calculates the SHA-256 hash of a file.
+func calculateSHA256Hash(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// getFileHash retrieves the hash of a project's file from the database.
+func (ca *CodeAssistant) getFileHash(projectName, relPath string) (FileHash, bool, error) {
+	var hash FileHash
+	err := ca.db.QueryRow("SELECT content_hash, model, prompt_version FROM file_hashes WHERE project = ? AND rel_path = ?", projectName, relPath).
+		Scan(&hash.ContentHash, &hash.Model, &hash.PromptVersion)
 	if err == sql.ErrNoRows {
-		return "", false, nil // File not found in the database
+		return FileHash{}, false, nil // File not found in the database
 	} else if err != nil {
-		return "", false, err // Other error
+		return FileHash{}, false, err // Other error
 	}
 	return hash, true, nil // Hash found
 }
 
-// setFileHash stores the file hash in the database.
-func (ca *CodeAssistant) setFileHash(filePath, hash string) error {
-	_, err := ca.db.Exec("INSERT OR REPLACE INTO file_hashes (file_path, hash) VALUES (?, ?)", filePath, hash)
+// setFileHash stores the hash of a project's file in the database.
+func (ca *CodeAssistant) setFileHash(projectName, relPath string, hash FileHash) error {
+	_, err := ca.db.Exec("INSERT OR REPLACE INTO file_hashes (project, rel_path, content_hash, model, prompt_version) VALUES (?, ?, ?, ?, ?)",
+		projectName, relPath, hash.ContentHash, hash.Model, hash.PromptVersion)
 	return err
 }
 
@@ -227,26 +282,28 @@ func (ca *CodeAssistant) parseDirectory(directoryPath string, excludeDirs []stri
 	return files, err
 }
 
-func (ca *CodeAssistant) generateComments(code string) (string, error) {
-	// Initialize the Ollama client
-	client, err := api.ClientFromEnvironment()
-	if err != nil {
-		return "", fmt.Errorf("failed to create Ollama client: %v", err)
-	}
-
-	// Prepare the prompt
-	prompt := fmt.Sprintf(`%s
+// docPrompt asks the documentation model to document a source file.
+// Increment docPromptVersion whenever it changes so existing docs are
+// regenerated on the next reindex.
+const (
+	docPrompt = `%s
 		Generate comments and documentation for this piece of code, only return text and do not return any code.
 
 		Do not skip any function defined. It is critically important that we cover all functions.
 		Also generate documentation only for functions and classes which are defined.
 
-		Documentation should be at function level or class level, no line-specific comments should be returned.`, code)
+		Documentation should be at function level or class level, no line-specific comments should be returned.`
+	docPromptVersion = 1
+)
+
+func (ca *CodeAssistant) generateComments(ctx context.Context, code string) (string, error) {
+	// Prepare the prompt
+	prompt := fmt.Sprintf(docPrompt, code)
 
 	// Create the chat request
-	req := &api.ChatRequest{
+	req := ChatRequest{
 		Model: ca.config.DocumentationModel,
-		Messages: []api.Message{
+		Messages: []Message{
 			{
 				Role:    "user",
 				Content: prompt,
@@ -255,69 +312,20 @@ func (ca *CodeAssistant) generateComments(code string) (string, error) {
 	}
 
 	var responseContent strings.Builder
-	respFunc := func(resp api.ChatResponse) error {
-		responseContent.WriteString(resp.Message.Content)
+	respFunc := func(token string) error {
+		responseContent.WriteString(token)
 		return nil
 	}
 
 	// Send the request to Ollama
-	err = client.Chat(context.Background(), req, respFunc)
-	if err != nil {
-		return "", fmt.Errorf("failed to generate comments: %v", err)
+	if err := ca.chat(ctx, req, respFunc); err != nil {
+		return "", fmt.Errorf("failed to generate comments: %w", err)
 	}
 
 	// Return the generated comments
 	return responseContent.String(), nil
 }
 
-// loadProjectConfig loads the project config from a JSON file.
-func (ca *CodeAssistant) loadProjectConfig(projectName string) (ProjectConfig, error) {
-	configPath := filepath.Join(ca.config.DocsDir, projectName, "project_config.json")
-	var config ProjectConfig
-	configFile, err := os.Open(configPath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			// Return an empty config if the file doesn't exist
-			return ProjectConfig{}, nil
-		}
-		return ProjectConfig{}, err
-	}
-	defer configFile.Close()
-
-	byteValue, _ := ioutil.ReadFile(configPath)
-
-	err = json.Unmarshal(byteValue, &config)
-	if err != nil {
-		return ProjectConfig{}, err
-	}
-	return config, nil
-}
-
-// saveProjectConfig saves the project config to a JSON file.
-func (ca *CodeAssistant) saveProjectConfig(config ProjectConfig) error {
-	configPath := filepath.Join(ca.config.DocsDir, config.ProjectName, "project_config.json")
-
-	// Ensure the directory exists
-	err := os.MkdirAll(filepath.Dir(configPath), os.ModePerm)
-	if err != nil {
-		return err
-	}
-
-	// Create the file
-	configFile, err := os.Create(configPath) // Use os.Create instead of json.Create
-	if err != nil {
-		return err
-	}
-	defer configFile.Close()
-
-	// Create a JSON encoder
-	encoder := json.NewEncoder(configFile)
-	encoder.SetIndent("", "  ") // Optional: Add indentation for readability
-
-	// Encode the config to the file
-	err = encoder.Encode(config)
-	return err
-}
 func (ca *CodeAssistant) getProjectDetails() (string, string, []string, []string, error) {
 
 	var projectName string
@@ -363,7 +371,7 @@ func (ca *CodeAssistant) indexCodebase(reindexProject string) error {
 	var err error
 
 	if reindexProject != "" {
-		ca.projectConfig, err = ca.loadProjectConfig(reindexProject)
+		projectConfig, err := ca.loadProjectConfig(reindexProject)
 
 		if err != nil {
 			fmt.Printf("Error loading project config: %v\n", err)
@@ -373,10 +381,10 @@ func (ca *CodeAssistant) indexCodebase(reindexProject string) error {
 				return fmt.Errorf("error getting project details: %v", err)
 			}
 		} else {
-			projectName = ca.projectConfig.ProjectName
-			path = ca.projectConfig.ProjectPath
-			exclude = ca.projectConfig.ExcludeFolders
-			excludeFiles = ca.projectConfig.ExcludeFiles
+			projectName = projectConfig.ProjectName
+			path = projectConfig.ProjectPath
+			exclude = projectConfig.ExcludeFolders
+			excludeFiles = projectConfig.ExcludeFiles
 		}
 
 	} else {
@@ -386,207 +394,316 @@ func (ca *CodeAssistant) indexCodebase(reindexProject string) error {
 			return fmt.Errorf("error getting project details: %v", err)
 		}
 	}
-	defaultExcludes := []string{"/node_modules", "/venv", "/build", "/dist", "/.venv", "/log", "/node_modules/", "/venv/", "/build/", "/dist/", "/.venv/", "/log/", "/.vite/", "/.git/"}
+	_, err = ca.indexProject(ca.ctx, nil, projectName, path, exclude, excludeFiles)
+	return err
+}
 
-	exclude = append(exclude, defaultExcludes...)
+// IndexResult summarizes a single indexing run.
+type IndexResult struct {
+	Project   string `json:"project"`
+	Files     int    `json:"files"`
+	Processed int    `json:"processed"`
+	Failed    int    `json:"failed"`
+	Updated   int    `json:"updated"`
+	Removed   int    `json:"removed"` // Files deleted from the codebase since the last run
+	Renamed   int    `json:"renamed"` // Files whose doc was moved to their new path
+}
 
-	projectDocsDir := filepath.Join(ca.config.DocsDir, projectName)
-	files, err := ca.parseDirectory(path, exclude, excludeFiles)
+// indexProject indexes the codebase at path under projectName without prompting.
+// When ctx is canceled the file being processed is finished, the progress is
+// saved to the project config and the run returns ctx.Err(). Progress is
+// reported to job when it is not nil. It fails with errProjectBusy when the
+// project is already being indexed.
+func (ca *CodeAssistant) indexProject(ctx context.Context, job *Job, projectName, path string, exclude, excludeFiles []string) (IndexResult, error) {
+	unlock, err := ca.registry.lock(projectName, "indexing")
 	if err != nil {
-		return err
+		return IndexResult{Project: projectName}, err
 	}
+	defer unlock()
+	return ca.indexProjectLocked(ctx, job, projectName, path, exclude, excludeFiles, ReindexOptions{})
+}
 
-	fmt.Printf("Indexing %d files...\n", len(files))
-	processedFiles := 0
-	failedFiles := 0
-	updatedFiles := 0 // Track the number of files that need reindexing
-
-	ca.projectConfig, err = ca.loadProjectConfig(reindexProject)
-	// Save the project config
+// indexProjectLocked is indexProject for a caller that holds the project's
+// lock. Instead of scanning the codebase, opts.Resume continues the project's
+// last unfinished run from its journal, if there is one, and opts.RetryFailed
+// only processes the files that failed before. opts.Wipe is not handled here.
+func (ca *CodeAssistant) indexProjectLocked(ctx context.Context, job *Job, projectName, path string, exclude, excludeFiles []string, opts ReindexOptions) (IndexResult, error) {
+	result := IndexResult{Project: projectName}
+	if projectName == "" || path == "" {
+		return result, fmt.Errorf("project name and codebase path are required")
+	}
+	done, err := ca.startIndexing()
 	if err != nil {
-		ca.projectConfig = ProjectConfig{
-			ProjectName:       projectName,
-			ProjectPath:       path,
-			ExcludeFolders:    exclude,
-			ExcludeFiles:      excludeFiles,
-			LastUpdated:       time.Now(),
-			TotalIndexedFiles: processedFiles,
-			TotalFailedFiles:  failedFiles,
-		}
-		err = ca.saveProjectConfig(ca.projectConfig)
-		if err != nil {
-			fmt.Printf("Error saving project config: %v\n", err)
-		}
+		return result, err
 	}
+	defer done()
+	release, err := ca.leaseProject(projectName)
+	if err != nil {
+		return result, err
+	}
+	defer release()
 
-	// Cool down configuration
-	const (
-		maxFileProcessTime  = 30 * time.Second // N seconds per file threshold
-		maxTotalProcessTime = 5 * time.Minute  // Y minutes total threshold
-		coolDownPeriod      = 60 * time.Second // X seconds to wait
-	)
-
-	var (
-		startTotalTime = time.Now()
-		lastCoolDown   time.Time
-	)
+	defaultExcludes := []string{"/node_modules", "/venv", "/build", "/dist", "/.venv", "/log", "/node_modules/", "/venv/", "/build/", "/dist/", "/.venv/", "/log/", "/.vite/", "/.git/"}
 
-	// Create a ticker for periodic saves
-	saveTicker := time.NewTicker(30 * time.Second)
-	defer saveTicker.Stop()
+	// Saved configs already contain the defaults, only add the missing ones
+	for _, defaultExclude := range defaultExcludes {
+		if !slices.Contains(exclude, defaultExclude) {
+			exclude = append(exclude, defaultExclude)
+		}
+	}
 
-	go func() {
-		for range saveTicker.C {
-			ca.projectConfig.LastUpdated = time.Now()
-			ca.projectConfig.TotalIndexedFiles = processedFiles
-			ca.projectConfig.TotalFailedFiles = failedFiles
+	processedFiles := 0
+	failedFiles := 0
+	updatedFiles := 0 // Track the number of files that need reindexing
 
-			if err := ca.saveProjectConfig(ca.projectConfig); err != nil {
-				fmt.Printf("Auto-save error: %v\n", err)
-			}
+	var files []string
+	var runID int64
+	resumed := false
+	switch {
+	case opts.Resume:
+		var pending []string
+		var err error
+		runID, pending, resumed, err = ca.resumableRun(projectName)
+		if err != nil {
+			return result, fmt.Errorf("error loading the last index run: %v", err)
 		}
-	}()
-	isLocalHost := strings.Contains(ca.config.OllamaHost, "localhost") //true
-	// Initialize with safe defaults (85°C critical, 65°C safe)
-	tempMonitor := NewTemperatureMonitor(80, 65, !isLocalHost)
-
-	bar := progressbar.Default(int64(len(files)))
-	for _, file := range files {
-
-		fileStartTime := time.Now()
-		// Check if we need cooldown
-		if time.Since(lastCoolDown) < coolDownPeriod {
-			if tempMonitor.useFallback {
-				remaining := coolDownPeriod - time.Since(lastCoolDown)
-				fmt.Printf("\nCooling down for %.0f more seconds...\n", remaining.Seconds())
-				time.Sleep(remaining)
-			} else {
-				temp, source, _ := tempMonitor.getTemperature()
-				if temp >= tempMonitor.criticalTemp {
-					color.Yellow("\n🚨 %s temperature critical (%.1f°C)",
-						strings.ToUpper(source), temp)
-					if err := tempMonitor.CoolDown(); err != nil {
-						color.Red("❌ Cooling failed: %v", err)
-					}
+		if !resumed {
+			fmt.Printf("No unfinished run of %s to resume, starting a new one\n", projectName)
+		}
+		for _, relPath := range pending {
+			file := filepath.Join(path, relPath)
+			if _, err := os.Stat(file); err != nil {
+				// Deleted since the run started, the next full run cleans up after it
+				if err := ca.setFileState(runID, relPath, FileSkipped, nil); err != nil {
+					return result, err
 				}
+				continue
 			}
-
+			files = append(files, file)
 		}
-
-		relPath, err := filepath.Rel(path, file)
+	case opts.RetryFailed:
+		failed, err := ca.failedFiles(projectName)
 		if err != nil {
-			fmt.Printf("Error getting relative path for %s: %v\n", file, err)
-			failedFiles++
-			bar.Add(1)
-			continue
+			return result, fmt.Errorf("error loading failed files: %v", err)
 		}
-		docPath := filepath.Join(projectDocsDir, relPath+".txt")
-
-		// Calculate the MD5 hash of the file
-		currentHash, err := calculateMD5Hash(file)
+		for _, failure := range failed {
+			file := filepath.Join(path, failure.Path)
+			if _, err := os.Stat(file); err != nil {
+				// Deleted since it failed, there is nothing left to retry
+				if err := ca.clearFailure(projectName, failure.Path); err != nil {
+					return result, err
+				}
+				continue
+			}
+			files = append(files, file)
+		}
+	}
+	fullScan := !resumed && !opts.RetryFailed
+	if resumed {
+		var err error
+		processedFiles, failedFiles, result.Files, err = ca.runFileCounts(runID)
 		if err != nil {
-			fmt.Printf("Error calculating hash for %s: %v\n", file, err)
-			failedFiles++
-			bar.Add(1)
-			continue // Skip this file and continue with the next
+			return result, fmt.Errorf("error loading the last index run: %v", err)
 		}
-
-		// Check if the file has changed
-		oldHash, found, err := ca.getFileHash(file)
+		fmt.Printf("Resuming indexing of %s, %d of %d files left...\n", projectName, len(files), result.Files)
+	} else if opts.RetryFailed {
+		result.Files = len(files)
+		fmt.Printf("Retrying %d failed files of %s...\n", len(files), projectName)
+	} else {
+		var err error
+		files, err = ca.parseDirectory(path, exclude, excludeFiles)
 		if err != nil {
-			fmt.Printf("Error getting hash for %s from DB: %v\n", file, err)
-			failedFiles++
-			bar.Add(1)
-			continue // Skip this file
+			return result, err
 		}
+		result.Files = len(files)
+		fmt.Printf("Indexing %d files...\n", len(files))
+	}
+	job.setTotal(len(files))
 
-		if found && oldHash == currentHash {
-			bar.Add(1)
-			continue // Skip unchanged files
+	projectConfig, err := ca.loadProjectConfig(projectName)
+	if err != nil {
+		return result, fmt.Errorf("error loading project config: %v", err)
+	}
+	// Register the project on its first run
+	if projectConfig.ProjectName == "" {
+		projectConfig = ProjectConfig{
+			ProjectName:    projectName,
+			ProjectPath:    path,
+			ExcludeFolders: exclude,
+			ExcludeFiles:   excludeFiles,
+			Status:         ProjectIndexing,
 		}
-		updatedFiles++ // Increment the number of files to reindex
-		fmt.Printf("Processing %s\n", file)
-		if err := os.MkdirAll(filepath.Dir(docPath), os.ModePerm); err != nil {
-			fmt.Printf("Error creating directory for %s: %v\n", file, err)
-			failedFiles++
-			bar.Add(1)
-			continue
+		if err := ca.saveProjectConfig(projectConfig); err != nil {
+			return result, err
 		}
+	}
+	// Docs embedded by the workers and not added to the vector store yet
+	embedded := map[string][]chromem.Document{}
+	unembedded, err := ca.unembeddedFiles(projectName)
+	if err != nil {
+		return result, fmt.Errorf("error loading the last index run: %v", err)
+	}
+	for _, relPath := range unembedded {
+		projectConfig.PendingFiles = addPendingFile(projectConfig.PendingFiles, relPath)
+	}
 
-		code, err := ioutil.ReadFile(file)
+	// A retry adds to the files indexed by the run it follows up on
+	indexedBefore := 0
+	if opts.RetryFailed {
+		indexedBefore = projectConfig.TotalIndexedFiles
+	}
+	// saveProgress stores only the fields indexing owns, so settings edited
+	// through the API while the run goes on are kept. The failed count covers
+	// every file still failing, whichever run it failed in.
+	saveProgress := func(status ProjectStatus) error {
+		failing, err := ca.countFailedFiles(projectName)
 		if err != nil {
-			fmt.Printf("Error reading file %s: %v\n", file, err)
-			failedFiles++
-			bar.Add(1)
-			continue
+			return err
 		}
-
-		comments, err := ca.generateComments(string(code))
+		return ca.updateProject(projectName, func(config *ProjectConfig) {
+			config.Status = status
+			config.LastUpdated = time.Now()
+			config.TotalIndexedFiles = indexedBefore + processedFiles
+			config.TotalFailedFiles = failing
+			config.PendingFiles = projectConfig.PendingFiles
+		})
+	}
+
+	if fullScan {
+		// Clean up after files that were deleted or renamed since the last run
+		result.Removed, result.Renamed, err = ca.reconcileFiles(&projectConfig, path, files)
 		if err != nil {
-			fmt.Printf("Error generating comments for %s: %v\n", file, err)
-			failedFiles++
-			bar.Add(1)
-			continue
+			return result, err
 		}
-
-		if err := ioutil.WriteFile(docPath, []byte(fmt.Sprintf("File: %s\n%s", relPath, comments)), 0644); err != nil {
-			fmt.Printf("Error writing doc file for %s: %v\n", file, err)
-			failedFiles++
-			bar.Add(1)
-			continue
+		if result.Removed > 0 || result.Renamed > 0 {
+			fmt.Printf("%d files removed, %d renamed\n", result.Removed, result.Renamed)
 		}
 
-		processedFiles++
-		bar.Add(1)
-		if processedFiles%10 == 0 {
-			fmt.Println("Cooling down for 5 seconds")
-			time.Sleep(10 * time.Second)
+	}
+	if !resumed {
+		relPaths := make([]string, 0, len(files))
+		current := map[string]bool{}
+		for _, file := range files {
+			if relPath, err := filepath.Rel(path, file); err == nil {
+				relPaths = append(relPaths, relPath)
+				current[relPath] = true
+			}
+		}
+		if fullScan {
+			if err := ca.pruneFailures(projectName, current); err != nil {
+				return result, fmt.Errorf("error pruning failed files: %v", err)
+			}
+		}
+		if runID, err = ca.startIndexRun(projectName, relPaths); err != nil {
+			return result, err
+		}
+	}
+	// recordFailure stores why a file failed, or forgets an earlier failure
+	// once the file is indexed.
+	recordFailure := func(relPath string, stage FailureStage, reason error) {
+		var err error
+		if reason != nil {
+			err = ca.recordFailure(projectName, relPath, stage, reason)
+		} else {
+			err = ca.clearFailure(projectName, relPath)
 		}
-
-		// Update the file hash in the database
-		err = ca.setFileHash(file, currentHash)
 		if err != nil {
-			fmt.Printf("Error setting hash for %s in DB: %v\n", file, err)
-			failedFiles++
+			fmt.Printf("Error recording the failure of %s: %v\n", relPath, err)
 		}
+	}
+	// setFileState records a file in the journal. A journal that falls behind
+	// only means a resumed run redoes some work, so errors are just reported.
+	setFileState := func(relPath string, state FileState, reason error) {
+		if err := ca.setFileState(runID, relPath, state, reason); err != nil {
+			fmt.Printf("Error recording %s in the index journal: %v\n", relPath, err)
+		}
+	}
+	// flush makes the docs embedded so far searchable
+	flush := func(ctx context.Context) {
+		if err := ca.flushEmbedded(ctx, job, &projectConfig, path, runID, embedded); err != nil {
+			fmt.Printf("Error adding docs to the vector store, they will be added after indexing: %v\n", err)
+		} else if err := saveProgress(ProjectIndexing); err != nil {
+			fmt.Printf("Auto-save error: %v\n", err)
+		}
+	}
+	if err := saveProgress(ProjectIndexing); err != nil {
+		fmt.Printf("Error saving project config: %v\n", err)
+	}
 
-		// Check for cooldown triggers after processing each file
-		fileProcessTime := time.Since(fileStartTime)
-		totalProcessTime := time.Since(startTotalTime)
-
-		if tempMonitor.useFallback && fileProcessTime > maxFileProcessTime || totalProcessTime > maxTotalProcessTime {
-			fmt.Printf("\nTriggering cooldown period (file: %.1fs, total: %.1fm)...\n",
-				fileProcessTime.Seconds(), totalProcessTime.Minutes())
-
-			lastCoolDown = time.Now()
-			time.Sleep(coolDownPeriod)
+	// Create a ticker for periodic saves, checked as results come in
+	saveTicker := time.NewTicker(30 * time.Second)
+	defer saveTicker.Stop()
 
-			// Reset timers after cooldown
-			startTotalTime = time.Now()
-		} else {
-			temp, source, _ := tempMonitor.getTemperature()
-			if temp >= tempMonitor.criticalTemp {
-				color.Yellow("\n🚨 %s temperature critical (%.1f°C)",
-					strings.ToUpper(source), temp)
-				if err := tempMonitor.CoolDown(); err != nil {
-					color.Red("❌ Cooling failed: %v", err)
-				}
+	bar := progressbar.Default(int64(len(files)))
+	ca.indexFiles(ctx, job, projectName, path, files, func(file fileResult) {
+		if file.changed {
+			updatedFiles++ // Increment the number of files to reindex
+		}
+		switch {
+		case file.canceled:
+			// Left for the next run
+			return
+		case file.err != nil:
+			fmt.Printf("Error processing %s: %v\n", file.file, file.err)
+			failedFiles++
+			job.fileFailed(file.relPath, file.err)
+			setFileState(file.relPath, FileFailed, file.err)
+			recordFailure(file.relPath, file.stage, file.err)
+		case !file.changed:
+			job.fileSkipped()
+			setFileState(file.relPath, FileSkipped, nil)
+			recordFailure(file.relPath, "", nil)
+		default:
+			// Remember the doc must be embedded even if this run is interrupted
+			projectConfig.PendingFiles = addPendingFile(projectConfig.PendingFiles, file.relPath)
+			if file.chunks != nil {
+				embedded[file.relPath] = file.chunks
 			}
+			// Update the file hash in the database
+			if err := ca.setFileHash(projectName, file.relPath, file.hash); err != nil {
+				fmt.Printf("Error setting hash for %s in DB: %v\n", file.file, err)
+				failedFiles++
+				job.fileFailed(file.relPath, err)
+				setFileState(file.relPath, FileFailed, err)
+				recordFailure(file.relPath, StageRecord, err)
+				break
+			}
+			processedFiles++
+			job.fileDocumented(file.relPath)
+			setFileState(file.relPath, FileDocumented, nil)
+			recordFailure(file.relPath, "", nil)
 		}
+		bar.Add(1)
 
+		if len(embedded) >= embedBatchFiles {
+			flush(ctx)
+			return
+		}
+		select {
+		case <-saveTicker.C:
+			flush(ctx)
+		default:
+		}
+	})
+	interrupted := ctx.Err() != nil
+	if interrupted {
+		// The docs are already embedded, adding them takes a moment
+		flush(context.Background())
+	}
+	// Save the progress, keeping settings such as retrieval overrides. The
+	// project is indexed once its docs are embedded.
+	status := ProjectIndexing
+	if interrupted {
+		status = ProjectInterrupted
+	}
+	err = ca.updateProject(projectName, func(config *ProjectConfig) {
+		config.ProjectPath = path
+		config.ExcludeFolders = exclude
+		config.ExcludeFiles = excludeFiles
+	})
+	if err == nil {
+		err = saveProgress(status)
 	}
-	// Save the project config
-	ca.projectConfig = ProjectConfig{
-		ProjectName:       projectName,
-		ProjectPath:       path,
-		ExcludeFolders:    exclude,
-		ExcludeFiles:      excludeFiles,
-		LastUpdated:       time.Now(),
-		TotalIndexedFiles: processedFiles,
-		TotalFailedFiles:  failedFiles,
-	}
-
-	err = ca.saveProjectConfig(ca.projectConfig)
 	if err != nil {
 		fmt.Printf("Error saving project config: %v\n", err)
 	}
@@ -598,84 +715,51 @@ func (ca *CodeAssistant) indexCodebase(reindexProject string) error {
 	fmt.Printf("Processed %d new files\n", processedFiles)
 	fmt.Printf("%d files failed to process.\n", failedFiles)
 
-	if updatedFiles > 0 {
-		fmt.Printf("%d files were updated and need reindexing.\n", updatedFiles)
-		//remove the whole vector DB and add code
-		os.RemoveAll(ca.config.HashDBPath)
-		db, err := chromem.NewPersistentDB(ca.config.HashDBPath, false)
+	result.Processed = processedFiles
+	result.Failed = failedFiles
+	result.Updated = updatedFiles
 
-		if err != nil {
-			return fmt.Errorf("failed to add document to vector DB: %v", err)
+	if interrupted {
+		if err := ca.finishIndexRun(runID, RunInterrupted); err != nil {
+			fmt.Printf("Error saving the index journal: %v\n", err)
 		}
-		ca.vectorDB = db
-
-		return ca.createVectorStore(projectName, path)
-
+		fmt.Printf("Indexing of %s interrupted, progress saved\n", projectName)
+		return result, ctx.Err()
 	}
-	return nil
-}
 
-func (ca *CodeAssistant) createVectorStore(projectName, codebasePath string) error {
-	projectDocsDir := filepath.Join(ca.config.DocsDir, projectName)
-
-	var documents []chromem.Document
-	err := filepath.Walk(projectDocsDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if !info.IsDir() && strings.HasSuffix(path, ".txt") {
-			content, err := ioutil.ReadFile(path)
-			if err != nil {
-				return err
-			}
-
-			relPath := strings.TrimSuffix(strings.TrimPrefix(path, projectDocsDir+string(filepath.Separator)), ".txt")
-			originalPath := filepath.Join(codebasePath, relPath)
-
-			documents = append(documents, chromem.Document{
-				ID:      relPath,
-				Content: string(content),
-				Metadata: map[string]string{
-					"file_path": originalPath,
-				},
-			})
-		}
-		return nil
-	})
-	if err != nil {
-		return err
+	err = ca.syncVectorStore(ctx, job, &projectConfig, path, embedded)
+	status = ProjectIndexed
+	runStatus := RunCompleted
+	if err == nil {
+		err = ca.markRunEmbedded(runID)
 	}
-
-	bar := progressbar.Default(3)
-	bar.Describe("Splitting documents")
-	// Simple text splitter (placeholder)
-	// splitter := func(text string) []string {
-	// 	return strings.Split(text, "\n\n") // Split by double newlines
-	// }
-	collec, err := ca.vectorDB.CreateCollection(projectName, nil, chromem.NewEmbeddingFuncOllama(ca.config.EmbeddingModel, ""))
 	if err != nil {
-		return fmt.Errorf("failed to add document to vector DB: %v", err)
+		status = ProjectFailed
+		runStatus = RunFailed
 	}
-	for _, doc := range documents {
-		if err := collec.AddDocument(context.Background(), doc); err != nil {
-			//{ID:doc.ID, Content:doc, Metadata: doc.Metadata}
-			return fmt.Errorf("failed to add document to vector DB: %v", err)
-		}
-		// chunks := splitter(doc.Content)
-		// for _, chunk := range chunks {
-		// 	// Add each chunk to the vector DB
-
-		// }
+	if err := ca.finishIndexRun(runID, runStatus); err != nil {
+		fmt.Printf("Error saving the index journal: %v\n", err)
+	}
+	if err := ca.updateProject(projectName, func(config *ProjectConfig) { config.Status = status }); err != nil {
+		fmt.Printf("Error saving project status: %v\n", err)
 	}
-	bar.Add(1)
+	return result, err
+}
 
-	bar.Describe("Saving vector store")
-	fmt.Printf("Index updated for %s with %d files\n", projectName, len(documents))
-	return nil
+// sleepContext sleeps for d or until ctx is canceled, whichever comes first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
 }
 
 func (ca *CodeAssistant) reindexCodebase() error {
-	projects, err := ca.listProjects(ca.config.DocsDir)
+	projects, err := ca.listProjects(ca.ctx)
 	if err != nil {
 		return err
 	}
@@ -701,25 +785,74 @@ func (ca *CodeAssistant) reindexCodebase() error {
 	fmt.Printf("Delete ALL data for %s and reindex? (y/n): ", selectedProject)
 	scanner.Scan()
 	confirm := strings.ToLower(scanner.Text())
-	if confirm == "y" {
-		docsPath := filepath.Join(ca.config.DocsDir, selectedProject)
+
+	_, err = ca.reindexProject(nil, selectedProject, ReindexOptions{Wipe: confirm == "y"})
+	return err
+}
+
+// ReindexOptions select how a known project is reindexed.
+type ReindexOptions struct {
+	Wipe        bool // Delete the generated docs and file hashes first so every file is documented again
+	Resume      bool // Continue the last unfinished run instead of starting a new one
+	RetryFailed bool // Only process the files that failed before
+}
+
+// reindexProject reindexes a known project using its saved config. Progress
+// is reported to job when it is not nil. It fails with errProjectBusy when
+// the project is already being indexed.
+func (ca *CodeAssistant) reindexProject(job *Job, projectName string, opts ReindexOptions) (IndexResult, error) {
+	unlock, err := ca.registry.lock(projectName, "indexing")
+	if err != nil {
+		return IndexResult{Project: projectName}, err
+	}
+	defer unlock()
+	return ca.reindexProjectLocked(job, projectName, opts)
+}
+
+// reindexProjectLocked is reindexProject for a caller that holds the project's lock.
+func (ca *CodeAssistant) reindexProjectLocked(job *Job, projectName string, opts ReindexOptions) (IndexResult, error) {
+	projectConfig, err := ca.loadProjectConfig(projectName)
+	if err != nil {
+		return IndexResult{Project: projectName}, fmt.Errorf("error loading project config: %v", err)
+	}
+	if projectConfig.ProjectPath == "" {
+		return IndexResult{Project: projectName}, fmt.Errorf("project %s has no saved codebase path", projectName)
+	}
+
+	if opts.Wipe && opts.Resume {
+		return IndexResult{Project: projectName}, fmt.Errorf("a wiped project has no run to resume")
+	}
+	if opts.RetryFailed && (opts.Wipe || opts.Resume) {
+		return IndexResult{Project: projectName}, fmt.Errorf("retrying failed files cannot be combined with wipe or resume")
+	}
+	if opts.Wipe {
+		docsPath := filepath.Join(ca.config.DocsDir, projectName)
 
 		if err := os.RemoveAll(docsPath); err != nil {
-			return err
+			return IndexResult{Project: projectName}, err
+		}
+		// Keep the project's settings. The collection is rebuilt from scratch
+		// at the end of the run and answers queries until then.
+		err = ca.updateProject(projectName, func(config *ProjectConfig) {
+			config.PendingEmbedding = true
+			config.PendingFiles = nil
+		})
+		if err != nil {
+			return IndexResult{Project: projectName}, err
 		}
 		// Delete file hash entries from the SQLite database for the selected project
-		_, err = ca.db.Exec("DELETE FROM file_hashes WHERE file_path LIKE ?", filepath.Join(ca.projectConfig.ProjectPath, "%"))
+		_, err = ca.db.Exec("DELETE FROM file_hashes WHERE project = ?", projectName)
 		if err != nil {
-			return fmt.Errorf("failed to delete file hash entries from DB: %v", err)
+			return IndexResult{Project: projectName}, fmt.Errorf("failed to delete file hash entries from DB: %v", err)
 		}
 	}
 
-	fmt.Printf("Reindexing %s...\n", selectedProject)
-	return ca.indexCodebase(selectedProject)
+	fmt.Printf("Reindexing %s...\n", projectName)
+	return ca.indexProjectLocked(ca.ctx, job, projectConfig.ProjectName, projectConfig.ProjectPath, projectConfig.ExcludeFolders, projectConfig.ExcludeFiles, opts)
 }
 
 func (ca *CodeAssistant) searchCodebaseCli() error {
-	projects, err := ca.listProjects(ca.config.DocsDir)
+	projects, err := ca.listProjects(ca.ctx)
 	if err != nil {
 		return err
 	}
@@ -744,6 +877,8 @@ func (ca *CodeAssistant) searchCodebaseCli() error {
 
 	fmt.Printf("Loaded %s. Enter queries (type 'exit' to quit):\n", selectedProject)
 
+	// The conversation is saved so it can be continued with ask --session
+	var session *ChatSession
 	for {
 		fmt.Print("\nQuery: ")
 		scanner.Scan()
@@ -752,87 +887,116 @@ func (ca *CodeAssistant) searchCodebaseCli() error {
 			break
 		}
 
-		fmt.Println("project name is ", selectedProject)
-		fmt.Println("query is", query)
+		if session == nil {
+			created, err := ca.openChatSession(ca.ctx, selectedProject, "", query)
+			if err != nil {
+				return err
+			}
+			session = &created
+			fmt.Printf("Chat session %s\n", session.ID)
+		}
 
-		res, err := ca.searchCodebase(selectedProject, query)
-		if err != nil {
-			fmt.Errorf("error occured: %v", err)
+		fmt.Println("\nThinking...")
+		_, _, err := ca.askInSession(ca.ctx, session, query, RetrievalConfig{}, func(token string) error {
+			_, err := fmt.Print(token)
 			return err
+		})
+		fmt.Println()
+		if err != nil {
+			return fmt.Errorf("error occured: %v", err)
 		}
-		fmt.Print(res)
 	}
 
 	return nil
 }
 
-func (ca *CodeAssistant) searchCodebase(projectName string, query string) (string, error) {
-	// Initialize the Ollama client
-	client, err := api.ClientFromEnvironment()
+// Source is a chunk of a generated doc that was used as context for an answer
+type Source struct {
+	ID         string  `json:"id"`
+	FilePath   string  `json:"file_path"`
+	StartLine  int     `json:"start_line,omitempty"` // Lines of the generated doc, when it was chunked
+	EndLine    int     `json:"end_line,omitempty"`
+	Similarity float32 `json:"similarity"`
+}
+
+// searchCodebase answers query from the project's indexed docs and returns the
+// docs it used. history holds earlier turns of the conversation, if any, and
+// retrieval overrides the configured retrieval settings for this question.
+// When onToken is not nil it receives the answer as it is generated;
+// returning an error from it or canceling ctx aborts the Ollama request.
+func (ca *CodeAssistant) searchCodebase(ctx context.Context, projectName string, query string, history []Message, retrieval RetrievalConfig, onToken func(string) error) (string, []Source, error) {
+	provider, err := ca.chatProvider(ca.config.CodeChatModel)
 	if err != nil {
-		return "", fmt.Errorf("failed to create Ollama client: %v", err)
+		return "", nil, err
+	}
+	settings := ca.retrievalSettings(projectName, retrieval)
+
+	// Follow-up questions like "where is that called from?" say little on their
+	// own, so search with the previous question as well
+	searchText := query
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].Role == "user" {
+			searchText = history[i].Content + "\n" + query
+			break
+		}
 	}
 	// Retrieve relevant documents from the vector DB
-	collec := ca.vectorDB.GetCollection(projectName, chromem.NewEmbeddingFuncOllama(ca.config.EmbeddingModel, ""))
-	results, err := collec.Query(context.Background(), query, 1, nil, nil) // Search for top 5 results
+	results, err := ca.queryVectorStore(ctx, projectName, searchText, settings.TopK)
 	if err != nil {
-		return "", fmt.Errorf("failed to search vector DB: %v", err)
-	}
-	// Display results
-	code := ""
-	fmt.Println("\nThinking...")
-	for _, result := range results {
-		// fmt.Printf("- %s: %s\n", result.ID, result.Content)
-		code = code + result.Content
+		return "", nil, err
 	}
-	// Prepare the prompt
+	results = slices.DeleteFunc(results, func(result chromem.Result) bool {
+		return result.Similarity < *settings.MinSimilarity
+	})
 
-	prompt := fmt.Sprintf(`
-		Context: %s
+	// Prepare the prompt
+	promptTemplate := `
+		Context:
+%s
 		Question: %s
-		Answer query clearly and concisely, include relevant file paths when applicable. Your answer should be related to this codebase only`, code, query)
+		Answer query clearly and concisely, include relevant file paths when applicable. Your answer should be related to this codebase only`
 
-	// fmt.Sprintf("%b", api)
-	// fmt.Println("prompt is ", prompt)
+	// Fill whatever the context window has left after the question, the
+	// conversation so far and room for the answer with retrieved docs
+	window := modelContextWindow(ctx, provider, ca.config.CodeChatModel)
+	budget := window - answerReserveTokens - estimateTokens(promptTemplate+query)
+	for _, message := range history {
+		budget -= estimateTokens(message.Content)
+	}
+	if settings.ContextTokens > 0 {
+		budget = min(budget, settings.ContextTokens)
+	}
+	code, sources := packContext(results, budget)
+	if code == "" {
+		code = "No documentation in this codebase matched the question."
+	}
+	prompt := fmt.Sprintf(promptTemplate, code, query)
 
 	// Create the chat request
-	req := &api.ChatRequest{
+	req := ChatRequest{
 		Model: ca.config.CodeChatModel,
-		Messages: []api.Message{
-			{
-				Role:    "user",
-				Content: prompt,
-			},
-		},
+		Messages: append(history, Message{
+			Role:    "user",
+			Content: prompt,
+		}),
+		ContextWindow: window,
 	}
 
 	var responseContent strings.Builder
-	respFunc := func(resp api.ChatResponse) error {
-		responseContent.WriteString(resp.Message.Content)
+	respFunc := func(token string) error {
+		responseContent.WriteString(token)
+		if onToken != nil {
+			return onToken(token)
+		}
 		return nil
 	}
 	// Send the request to Ollama
-	err = client.Chat(context.Background(), req, respFunc)
-	if err != nil {
-		return "", fmt.Errorf("failed to generate comments: %v", err)
+	if err := ca.chat(ctx, req, respFunc); err != nil {
+		return "", nil, fmt.Errorf("failed to generate comments: %w", err)
 	}
 
 	// Return the generated comments
-	return responseContent.String(), nil
-}
-
-func (ca *CodeAssistant) listProjects(dir string) ([]string, error) {
-	var projects []string
-	entries, err := os.ReadDir(dir)
-	if err != nil {
-		return nil, err
-	}
-	for _, entry := range entries {
-		if entry.IsDir() {
-			projects = append(projects, entry.Name())
-		}
-	}
-	return projects, nil
+	return responseContent.String(), sources, nil
 }
 
 func (ca *CodeAssistant) runCLI() {
@@ -846,7 +1010,11 @@ func (ca *CodeAssistant) runCLI() {
 		fmt.Print("Select option: ")
 
 		scanner := bufio.NewScanner(os.Stdin)
-		scanner.Scan()
+		if !scanner.Scan() {
+			// Stdin is closed (no TTY), use the serve command to run headless
+			fmt.Println("\nInput closed, exiting...")
+			return
+		}
 		choice := scanner.Text()
 
 		switch choice {
@@ -866,7 +1034,7 @@ func (ca *CodeAssistant) runCLI() {
 			// fmt.Print("Enter repository path: ")
 			// scanner.Scan()
 			// repoPath := scanner.Text()
-			projects, err := ca.listProjects(ca.config.DocsDir)
+			projects, err := ca.listProjects(ca.ctx)
 			if err != nil {
 				fmt.Printf("Error: %v\n", err)
 			}
@@ -888,12 +1056,12 @@ func (ca *CodeAssistant) runCLI() {
 			selectedIndex := 0
 			fmt.Sscanf(choice, "%d", &selectedIndex)
 			selectedProject := projects[selectedIndex-1]
-			ca.projectConfig, err = ca.loadProjectConfig(selectedProject)
+			projectConfig, err := ca.loadProjectConfig(selectedProject)
 
 			if err != nil {
 				fmt.Printf("Error: %v\n", err)
 			}
-			repoPath := ca.projectConfig.ProjectPath
+			repoPath := projectConfig.ProjectPath
 			if err := ca.reviewCommit(repoPath); err != nil {
 				fmt.Printf("Error: %v\n", err)
 			}
@@ -908,80 +1076,81 @@ func (ca *CodeAssistant) runCLI() {
 
 // Web UI Handlers
 func (ca *CodeAssistant) homeHandler(w http.ResponseWriter, r *http.Request) {
-	projects, err := ca.listProjects(ca.config.DocsDir)
+	projects, err := ca.listProjects(r.Context())
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error listing projects: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	// Parse the template
-	tmpl, err := template.ParseFiles("templates/index.html")
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error parsing template: %v", err), http.StatusInternalServerError)
-		return
-	}
-
 	data := map[string][]string{
 		"Projects": projects,
 	}
 
-	// Execute the template
-	err = tmpl.Execute(w, data)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error executing template: %v", err), http.StatusInternalServerError)
-		return
-	}
+	ca.renderTemplate(w, r, "templates/index.html", data)
 }
 
 func (ca *CodeAssistant) projectHandler(w http.ResponseWriter, r *http.Request) {
 	projectName := r.URL.Path[len("/project/"):] // Extract project name from URL
+	if !ca.authorize(w, r, projectName, RoleViewer) {
+		return
+	}
 	projectConfig, err := ca.loadProjectConfig(projectName)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error loading project config: %v", err), http.StatusInternalServerError)
 		return
 	}
-	// Parse the template
-	tmpl, err := template.ParseFiles("templates/project.html")
+	failed, err := ca.failedFiles(projectName)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error parsing template: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Error loading failed files: %v", err), http.StatusInternalServerError)
 		return
 	}
-
-	err = tmpl.Execute(w, projectConfig)
-
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error executing template: %v", err), http.StatusInternalServerError)
-		return
+	data := struct {
+		ProjectConfig
+		Job         *JobSnapshot // Latest indexing job for the project, if any
+		FailedFiles []FailedFile
+	}{ProjectConfig: projectConfig, FailedFiles: failed}
+	if job, ok := ca.jobs.Latest(projectName); ok {
+		snapshot := job.Snapshot()
+		data.Job = &snapshot
 	}
+
+	ca.renderTemplate(w, r, "templates/project.html", data)
 }
 
 func (ca *CodeAssistant) indexHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("calling index code base")
-	err := ca.indexCodebase("") // force to ask code details
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error Indexing: %v", err), http.StatusInternalServerError)
-		return
-	}
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+	ca.renderTemplate(w, r, "templates/new_project.html", nil)
 }
 
 func (ca *CodeAssistant) chatHandler(w http.ResponseWriter, r *http.Request) {
 	projectName := r.URL.Path[len("/chat/"):]
-	// Parse the template
-	tmpl, err := template.ParseFiles("templates/chat.html")
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error parsing template: %v", err), http.StatusInternalServerError)
+	if !ca.authorize(w, r, projectName, RoleViewer) {
 		return
 	}
-	data := map[string]string{
-		"ProjectName": projectName,
-	}
-	err = tmpl.Execute(w, data)
 
+	username, allUsers := ca.sessionOwner(r.Context())
+	sessions, err := ca.listChatSessions(projectName, username, allUsers)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error executing template: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Error listing chat sessions: %v", err), http.StatusInternalServerError)
 		return
 	}
+	data := struct {
+		ProjectName string
+		Sessions    []ChatSession
+		Session     *ChatSession // Session being resumed, if any
+	}{ProjectName: projectName, Sessions: sessions}
+
+	if id := r.URL.Query().Get("session"); id != "" {
+		session, err := ca.openChatSession(r.Context(), projectName, id, "")
+		if err == errChatSessionNotFound {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			http.Error(w, fmt.Sprintf("Error loading chat session: %v", err), http.StatusInternalServerError)
+			return
+		}
+		data.Session = &session
+	}
+	ca.renderTemplate(w, r, "templates/chat.html", data)
 }
 
 func (ca *CodeAssistant) queryHandler(w http.ResponseWriter, r *http.Request) {
@@ -992,50 +1161,80 @@ func (ca *CodeAssistant) queryHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Project name and query are required", http.StatusBadRequest)
 		return
 	}
+	if !ca.authorize(w, r, projectName, RoleViewer) {
+		return
+	}
 
-	response, err := ca.searchCodebase(projectName, query)
+	session, err := ca.openChatSession(r.Context(), projectName, r.FormValue("session_id"), query)
+	if err == errChatSessionNotFound {
+		http.Error(w, "Chat session not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, fmt.Sprintf("Error opening chat session: %v", err), http.StatusInternalServerError)
+		return
+	}
+	// Tell the page which session to continue with the next question
+	w.Header().Set("X-Chat-Session", session.ID)
+
+	// The answer is streamed as chunked HTML while the model generates it. The
+	// request context is canceled when the client goes away, which also
+	// cancels the Ollama request.
+	flusher, _ := w.(http.Flusher)
+	started := false
+	_, _, err = ca.askInSession(r.Context(), &session, query, retrievalFromForm(r), func(token string) error {
+		if !started {
+			started = true
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+			fmt.Fprintf(w, "<p><strong>Query:</strong> %s</p><p><strong>Response:</strong> ", template.HTMLEscapeString(query))
+		}
+		// Escape the response for HTML to prevent XSS
+		if _, err := io.WriteString(w, template.HTMLEscapeString(token)); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error searching codebase: %v", err), http.StatusInternalServerError)
+		if r.Context().Err() != nil {
+			return // Client disconnected
+		}
+		if !started {
+			status := http.StatusInternalServerError
+			if errors.Is(err, errLLMUnavailable) {
+				status = http.StatusServiceUnavailable
+			}
+			http.Error(w, fmt.Sprintf("Error searching codebase: %v", err), status)
+			return
+		}
+		fmt.Fprintf(w, "</p><p class=\"error-message\">Error: %s</p>", template.HTMLEscapeString(err.Error()))
 		return
 	}
-
-	// Escape the response for HTML to prevent XSS
-	escapedResponse := template.HTMLEscapeString(response)
-
-	// Create the HTML response
-	htmlResponse := fmt.Sprintf("<p><strong>Query:</strong> %s</p><p><strong>Response:</strong> %s</p>", template.HTMLEscapeString(query), escapedResponse)
-
-	w.Header().Set("Content-Type", "text/html")
-	w.Write([]byte(htmlResponse))
+	if !started {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(w, "<p><strong>Query:</strong> %s</p><p><strong>Response:</strong> ", template.HTMLEscapeString(query))
+	}
+	io.WriteString(w, "</p>")
 }
 
 func (ca *CodeAssistant) reindexHandler(w http.ResponseWriter, r *http.Request) {
-	err := ca.reindexCodebase() // force to ask code details
+	projects, err := ca.listProjects(r.Context())
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error Reindexing: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Error listing projects: %v", err), http.StatusInternalServerError)
 		return
 	}
-	http.Redirect(w, r, "/", http.StatusSeeOther)
-}
 
-// StartWebServer starts the web server
-func (ca *CodeAssistant) StartWebServer() {
-	http.HandleFunc("/", ca.homeHandler)
-	http.HandleFunc("/project/", ca.projectHandler)
-	http.HandleFunc("/index", ca.indexHandler)
-	http.HandleFunc("/chat/", ca.chatHandler)
-	http.HandleFunc("/query", ca.queryHandler)
-	http.HandleFunc("/reindex", ca.reindexHandler)
-
-	// Serve static files (CSS, JS, etc.)
-	fs := http.FileServer(http.Dir("static"))
-	http.Handle("/static/", http.StripPrefix("/static/", fs))
-	fmt.Printf("Starting web server on :%s\n", ca.config.WebPort)
-	log.Fatal(http.ListenAndServe("0.0.0.0:"+ca.config.WebPort, nil))
+	data := map[string][]string{
+		"Projects": ca.visibleProjects(r.Context(), projects, RoleMaintainer),
+	}
+
+	ca.renderTemplate(w, r, "templates/reindex.html", data)
 }
 
 func (ca *CodeAssistant) loadProjects() error {
-	projects, err := ca.listProjects(ca.config.DocsDir)
+	projects, err := ca.listProjects(ca.ctx)
 	if err != nil {
 		return err
 	}
@@ -1059,23 +1258,36 @@ func (ca *CodeAssistant) run() {
 }
 
 func main() {
+	configPath := flag.String("config", "config.json", "path to the config file")
+	offline := flag.Bool("offline", false, "never pull models, fail when one is missing")
+	flag.Usage = func() { fmt.Fprint(os.Stderr, cliUsage) }
+	flag.Parse()
+
 	// Load global configuration
-	config, err := LoadConfig("config.json")
+	config, err := LoadConfig(*configPath)
 	if err != nil {
-		fmt.Printf("Failed to load config: %v\n", err)
-		return
+		fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
+		os.Exit(exitError)
+	}
+	if *offline {
+		config.Offline = true
 	}
 
-	// Set OLLAMA_HOST environment variable
-	os.Setenv("OLLAMA_HOST", config.OllamaHost)
-
-	if err := MakeModelsAvailable(config); err != nil {
-		log.Fatalf("Error getting models: %v", err)
+	// Run a subcommand when one is given, otherwise fall back to the interactive menu
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(config, flag.Args()))
 	}
 
 	// Initialize and run the code assistant
-	assistant := NewCodeAssistant(config)
-	if assistant != nil {
-		assistant.run()
+	assistant, err := NewCodeAssistant(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitError)
+	}
+	if err := assistant.provisionModels(assistant.ctx, false); err != nil {
+		fmt.Fprintf(os.Stderr, "Error getting models: %v\n", err)
+		assistant.Close()
+		os.Exit(exitError)
 	}
+	assistant.run()
 }
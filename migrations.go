@@ -0,0 +1,180 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrationFiles holds the SQL migrations, named NNNN_description.sql where
+// NNNN is the schema version they bring the database to.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// goMigrations are the steps SQL alone cannot express, such as ones that read
+// project configs. They are ordered together with the SQL migrations.
+var goMigrations = []migration{
+	{version: 5, name: "file_hashes_per_project", run: (*CodeAssistant).migrateFileHashes},
+	{version: 7, name: "import_project_configs", run: (*CodeAssistant).importProjectConfigs},
+}
+
+// migration brings the schema to version, either by running sql or by calling run.
+type migration struct {
+	version int
+	name    string
+	sql     string
+	run     func(ca *CodeAssistant, tx *sql.Tx) error
+}
+
+// MigrationStatus describes a migration and when it was applied, if it was.
+type MigrationStatus struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name"`
+	AppliedAt *time.Time `json:"applied_at,omitempty"`
+}
+
+// loadMigrations returns every migration in version order.
+func loadMigrations() ([]migration, error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+	all := append([]migration{}, goMigrations...)
+	for _, entry := range entries {
+		prefix, name, ok := strings.Cut(strings.TrimSuffix(entry.Name(), ".sql"), "_")
+		version, err := strconv.Atoi(prefix)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("invalid migration file name %s", entry.Name())
+		}
+		content, err := migrationFiles.ReadFile(path.Join("migrations", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, migration{version: version, name: name, sql: string(content)})
+	}
+
+	sort.Slice(all, func(i, j int) bool { return all[i].version < all[j].version })
+	for i := range all {
+		if all[i].version != i+1 {
+			return nil, fmt.Errorf("migration %d (%s) is out of sequence, expected version %d", all[i].version, all[i].name, i+1)
+		}
+	}
+	return all, nil
+}
+
+// appliedMigrations returns when each applied schema version was applied,
+// creating the schema_version table if needed.
+func (ca *CodeAssistant) appliedMigrations() (map[int]time.Time, error) {
+	_, err := ca.db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_version (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at TIMESTAMP NOT NULL
+		)
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create schema_version table: %v", err)
+	}
+
+	rows, err := ca.db.Query("SELECT version, applied_at FROM schema_version")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+// migrateDatabase applies the pending migrations in order, each in its own
+// transaction, and returns the ones it applied. It refuses to touch a database
+// that a newer version of CodeSage has migrated further.
+func (ca *CodeAssistant) migrateDatabase() ([]MigrationStatus, error) {
+	all, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	applied, err := ca.appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+	for version := range applied {
+		if version > len(all) {
+			return nil, fmt.Errorf("database schema is at version %d but this version of CodeSage only knows %d migrations", version, len(all))
+		}
+	}
+
+	done := []MigrationStatus{}
+	for _, m := range all {
+		if _, ok := applied[m.version]; ok {
+			continue
+		}
+		appliedAt, err := ca.applyMigration(m)
+		if err != nil {
+			return done, fmt.Errorf("migration %d (%s) failed: %v", m.version, m.name, err)
+		}
+		fmt.Printf("Applied migration %d (%s)\n", m.version, m.name)
+		done = append(done, MigrationStatus{Version: m.version, Name: m.name, AppliedAt: &appliedAt})
+	}
+	return done, nil
+}
+
+// applyMigration runs one migration and records it in the same transaction.
+func (ca *CodeAssistant) applyMigration(m migration) (time.Time, error) {
+	tx, err := ca.db.Begin()
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer tx.Rollback()
+
+	if m.run != nil {
+		err = m.run(ca, tx)
+	} else {
+		_, err = tx.Exec(m.sql)
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	now := time.Now()
+	if _, err := tx.Exec("INSERT INTO schema_version (version, name, applied_at) VALUES (?, ?, ?)", m.version, m.name, now); err != nil {
+		return time.Time{}, err
+	}
+	return now, tx.Commit()
+}
+
+// migrationStatus lists every known migration and when it was applied.
+func (ca *CodeAssistant) migrationStatus() ([]MigrationStatus, error) {
+	all, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	applied, err := ca.appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	status := make([]MigrationStatus, 0, len(all))
+	for _, m := range all {
+		entry := MigrationStatus{Version: m.version, Name: m.name}
+		if appliedAt, ok := applied[m.version]; ok {
+			entry.AppliedAt = &appliedAt
+		}
+		status = append(status, entry)
+	}
+	return status, nil
+}
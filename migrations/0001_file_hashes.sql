@@ -0,0 +1,7 @@
+-- Hashes of indexed source files, keyed by absolute path.
+-- The baseline migrations use IF NOT EXISTS because databases created before
+-- schema_version existed already have these tables.
+CREATE TABLE IF NOT EXISTS file_hashes (
+	file_path TEXT PRIMARY KEY,
+	hash TEXT
+);
@@ -0,0 +1,12 @@
+-- Web login users and their sessions
+CREATE TABLE IF NOT EXISTS users (
+	username TEXT PRIMARY KEY,
+	password_hash TEXT NOT NULL,
+	created_at TIMESTAMP
+);
+CREATE TABLE IF NOT EXISTS web_sessions (
+	token_hash TEXT PRIMARY KEY,
+	username TEXT NOT NULL,
+	csrf_token TEXT NOT NULL,
+	expires_at TIMESTAMP NOT NULL
+);
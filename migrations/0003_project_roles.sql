@@ -0,0 +1,8 @@
+-- Per-project roles of web users, project "*" applies to every project
+CREATE TABLE IF NOT EXISTS project_roles (
+	username TEXT NOT NULL,
+	project TEXT NOT NULL,
+	role TEXT NOT NULL,
+	granted_at TIMESTAMP,
+	PRIMARY KEY (username, project)
+);
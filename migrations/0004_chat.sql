@@ -0,0 +1,20 @@
+-- Persisted chat sessions and their messages
+CREATE TABLE IF NOT EXISTS chat_sessions (
+	id TEXT PRIMARY KEY,
+	project TEXT NOT NULL,
+	username TEXT NOT NULL,
+	title TEXT,
+	summary TEXT,
+	summarized_through INTEGER,
+	created_at TIMESTAMP,
+	updated_at TIMESTAMP
+);
+CREATE TABLE IF NOT EXISTS chat_messages (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	session_id TEXT NOT NULL,
+	role TEXT NOT NULL,
+	content TEXT NOT NULL,
+	sources TEXT,
+	created_at TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS chat_messages_session ON chat_messages (session_id, id);
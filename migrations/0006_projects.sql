@@ -0,0 +1,16 @@
+-- Indexed projects, replacing the project_config.json file in each docs folder.
+-- List and object settings are stored as JSON.
+CREATE TABLE projects (
+	name TEXT PRIMARY KEY,
+	path TEXT NOT NULL,
+	exclude_folders TEXT NOT NULL DEFAULT '[]',
+	exclude_files TEXT NOT NULL DEFAULT '[]',
+	retrieval TEXT NOT NULL DEFAULT '{}',
+	status TEXT NOT NULL DEFAULT 'new',
+	total_indexed_files INTEGER NOT NULL DEFAULT 0,
+	total_failed_files INTEGER NOT NULL DEFAULT 0,
+	pending_embedding INTEGER NOT NULL DEFAULT 0,
+	pending_files TEXT NOT NULL DEFAULT '[]',
+	created_at TIMESTAMP NOT NULL,
+	last_updated TIMESTAMP
+);
@@ -0,0 +1,20 @@
+-- Journal of index runs, so an interrupted run can be resumed and its counts
+-- survive a crash. index_run_files holds each file's state in the run:
+-- pending, skipped (unchanged), documented, embedded or failed.
+CREATE TABLE index_runs (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	project TEXT NOT NULL,
+	status TEXT NOT NULL,
+	started_at TIMESTAMP NOT NULL,
+	finished_at TIMESTAMP
+);
+CREATE INDEX index_runs_project ON index_runs (project, id);
+
+CREATE TABLE index_run_files (
+	run_id INTEGER NOT NULL,
+	rel_path TEXT NOT NULL,
+	state TEXT NOT NULL,
+	error TEXT NOT NULL DEFAULT '',
+	updated_at TIMESTAMP NOT NULL,
+	PRIMARY KEY (run_id, rel_path)
+);
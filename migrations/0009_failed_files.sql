@@ -0,0 +1,11 @@
+-- Files that could not be indexed, kept until they are indexed or removed
+-- from the codebase. stage is the step that failed.
+CREATE TABLE failed_files (
+	project TEXT NOT NULL,
+	rel_path TEXT NOT NULL,
+	stage TEXT NOT NULL,
+	error TEXT NOT NULL,
+	attempts INTEGER NOT NULL,
+	failed_at TIMESTAMP NOT NULL,
+	PRIMARY KEY (project, rel_path)
+);
@@ -0,0 +1,9 @@
+-- Embedding model and vector dimension each project's collection was built
+-- with, so a collection is rebuilt rather than mixed with other embeddings.
+-- dimension is 0 until the collection holds a document.
+CREATE TABLE vector_collections (
+	project TEXT PRIMARY KEY,
+	embedding_model TEXT NOT NULL,
+	dimension INTEGER NOT NULL,
+	created_at TIMESTAMP NOT NULL
+);
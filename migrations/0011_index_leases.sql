@@ -0,0 +1,9 @@
+-- Which process is indexing each project. The per-project locks only hold
+-- within one process, so a CLI run and the web server claim a lease here and
+-- renew it while they index. A lease not renewed for a while belongs to a
+-- process that died and may be taken over.
+CREATE TABLE index_leases (
+	project TEXT PRIMARY KEY,
+	owner TEXT NOT NULL,
+	heartbeat_at TIMESTAMP NOT NULL
+);
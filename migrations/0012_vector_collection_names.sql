@@ -0,0 +1,5 @@
+-- Name of the chromem collection holding each project's vectors. A rebuilt
+-- collection is created under a new name next to the old one, which keeps
+-- answering queries until this column is switched to it. Empty means the
+-- collection is named after the project, as before rebuilds were swapped in.
+ALTER TABLE vector_collections ADD COLUMN collection TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ollama/ollama/api"
+	"github.com/schollz/progressbar/v3"
+)
+
+// modelCheckTimeout bounds looking up the models, so an unreachable Ollama
+// fails startup quickly instead of hanging
+const modelCheckTimeout = 10 * time.Second
+
+// ModelState is how far a configured model is from being usable
+type ModelState string
+
+const (
+	ModelChecking  ModelState = "checking"  // Not looked up yet
+	ModelAvailable ModelState = "available" // On the server, ready to use
+	ModelMissing   ModelState = "missing"   // Not on the server yet
+	ModelPulling   ModelState = "pulling"
+	ModelFailed    ModelState = "failed"   // The lookup or the pull failed, see Error
+	ModelExternal  ModelState = "external" // Served by a provider that manages its own models
+)
+
+// ModelStatus is the provisioning state of one configured model
+type ModelStatus struct {
+	Name          string     `json:"name"`
+	Uses          []string   `json:"uses"` // embedding, chat and documentation
+	Provider      string     `json:"provider"`
+	Host          string     `json:"host,omitempty"`
+	State         ModelState `json:"state"`
+	Size          int64      `json:"size,omitempty"`           // Bytes on disk
+	ContextLength int        `json:"context_length,omitempty"` // Context length the model was trained with
+	PullStatus    string     `json:"pull_status,omitempty"`    // Step of the pull in progress, as reported by Ollama
+	Pulled        int64      `json:"pulled,omitempty"`         // Bytes of the current layer pulled so far
+	PullTotal     int64      `json:"pull_total,omitempty"`
+	Error         string     `json:"error,omitempty"`
+}
+
+// PullPercent returns how much of the current layer has been pulled.
+func (s ModelStatus) PullPercent() int {
+	if s.PullTotal <= 0 {
+		return 0
+	}
+	return int(s.Pulled * 100 / s.PullTotal)
+}
+
+// modelTracker holds the status of the configured models for the startup
+// report, the web UI and the API.
+type modelTracker struct {
+	mu     sync.Mutex
+	models []ModelStatus
+}
+
+// newModelTracker lists the models of config, each once with everything it
+// is used for.
+func newModelTracker(config Config) *modelTracker {
+	t := &modelTracker{}
+	for _, model := range []struct{ name, use string }{
+		{config.EmbeddingModel, "embedding"},
+		{config.CodeChatModel, "chat"},
+		{config.DocumentationModel, "documentation"},
+	} {
+		if model.name == "" {
+			continue
+		}
+		if i := t.index(model.name); i >= 0 {
+			t.models[i].Uses = append(t.models[i].Uses, model.use)
+			continue
+		}
+		provider := config.ModelProviders[model.name]
+		status := ModelStatus{Name: model.name, Uses: []string{model.use}, Provider: provider.Type, Host: provider.BaseURL, State: ModelChecking}
+		if status.Provider == "" {
+			status.Provider = ProviderOllama
+		}
+		if status.Host == "" && status.Provider == ProviderOllama {
+			status.Host = config.OllamaHost
+		}
+		t.models = append(t.models, status)
+	}
+	return t
+}
+
+// index returns the position of the named model, or -1. The caller holds
+// t.mu or has not shared t yet.
+func (t *modelTracker) index(name string) int {
+	for i, model := range t.models {
+		if model.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// list returns a copy of the statuses.
+func (t *modelTracker) list() []ModelStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	models := make([]ModelStatus, len(t.models))
+	copy(models, t.models)
+	return models
+}
+
+// update changes the status of the named model with fn.
+func (t *modelTracker) update(name string, fn func(status *ModelStatus)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if i := t.index(name); i >= 0 {
+		fn(&t.models[i])
+	}
+}
+
+// sameModel reports whether two Ollama model names refer to the same model,
+// a name without a tag meaning its latest tag.
+func sameModel(a, b string) bool {
+	withTag := func(name string) string {
+		if !strings.Contains(name[strings.LastIndex(name, "/")+1:], ":") {
+			return name + ":latest"
+		}
+		return name
+	}
+	return withTag(a) == withTag(b)
+}
+
+// findModel returns the named model of an Ollama model list.
+func findModel(list *api.ListResponse, name string) (api.ListModelResponse, bool) {
+	for _, model := range list.Models {
+		if sameModel(model.Name, name) || sameModel(model.Model, name) {
+			return model, true
+		}
+	}
+	return api.ListModelResponse{}, false
+}
+
+// checkModels looks the configured models up on their servers and returns
+// the Ollama models that still have to be pulled. It fails when an Ollama
+// server cannot be reached.
+func (ca *CodeAssistant) checkModels(ctx context.Context) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, modelCheckTimeout)
+	defer cancel()
+
+	var missing []string
+	lists := map[string]*api.ListResponse{} // Models on each Ollama server, by host
+	for _, status := range ca.models.list() {
+		if status.Provider != ProviderOllama {
+			// Other servers load their models themselves, only ask chat
+			// models for their context length
+			length := 0
+			if provider, err := ca.chatProvider(status.Name); err == nil {
+				length, _ = provider.ContextLength(ctx, status.Name)
+			}
+			ca.models.update(status.Name, func(s *ModelStatus) {
+				s.State, s.ContextLength = ModelExternal, length
+			})
+			continue
+		}
+
+		provider, err := ca.newOllamaProvider(ca.config.ModelProviders[status.Name])
+		if err != nil {
+			return nil, err
+		}
+		list, ok := lists[status.Host]
+		if !ok {
+			if list, err = provider.client.List(ctx); err != nil {
+				host := status.Host
+				if host == "" {
+					host = "OLLAMA_HOST"
+				}
+				err = fmt.Errorf("cannot reach Ollama at %s, is it running? %v", host, err)
+				ca.models.update(status.Name, func(s *ModelStatus) { s.State, s.Error = ModelFailed, err.Error() })
+				return nil, err
+			}
+			lists[status.Host] = list
+		}
+
+		model, found := findModel(list, status.Name)
+		if !found {
+			missing = append(missing, status.Name)
+			ca.models.update(status.Name, func(s *ModelStatus) { s.State = ModelMissing })
+			continue
+		}
+		ca.models.update(status.Name, func(s *ModelStatus) { s.State, s.Size, s.Error = ModelAvailable, model.Size, "" })
+		ca.readContextLength(ctx, provider, status.Name)
+	}
+	return missing, nil
+}
+
+// readContextLength records the context length Ollama reports for model.
+// Models that do not report one are left without.
+func (ca *CodeAssistant) readContextLength(ctx context.Context, provider *ollamaProvider, model string) {
+	length, err := provider.ContextLength(ctx, model)
+	if err != nil {
+		return
+	}
+	ca.models.update(model, func(s *ModelStatus) { s.ContextLength = length })
+}
+
+// pullModels pulls the given Ollama models one at a time, showing the
+// progress on the command line and in ca.models for the web UI.
+func (ca *CodeAssistant) pullModels(ctx context.Context, models []string) error {
+	for _, model := range models {
+		provider, err := ca.newOllamaProvider(ca.config.ModelProviders[model])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Pulling model %s\n", model)
+		ca.models.update(model, func(s *ModelStatus) { s.State, s.Error = ModelPulling, "" })
+
+		bar := progressbar.DefaultBytes(-1, model)
+		err = provider.client.Pull(ctx, &api.PullRequest{Model: model}, func(progress api.ProgressResponse) error {
+			bar.Describe(fmt.Sprintf("%s: %s", model, progress.Status))
+			if progress.Total > 0 {
+				bar.ChangeMax64(progress.Total)
+				bar.Set64(progress.Completed)
+			}
+			ca.models.update(model, func(s *ModelStatus) {
+				s.PullStatus, s.Pulled, s.PullTotal = progress.Status, progress.Completed, progress.Total
+			})
+			return nil
+		})
+		bar.Finish()
+		ca.models.update(model, func(s *ModelStatus) { s.PullStatus, s.Pulled, s.PullTotal = "", 0, 0 })
+		if err != nil {
+			err = fmt.Errorf("failed to pull model %s: %v", model, err)
+			ca.models.update(model, func(s *ModelStatus) { s.State, s.Error = ModelFailed, err.Error() })
+			return err
+		}
+		var size int64
+		if list, err := provider.client.List(ctx); err == nil {
+			pulled, _ := findModel(list, model)
+			size = pulled.Size
+		}
+		ca.models.update(model, func(s *ModelStatus) { s.State, s.Size = ModelAvailable, size })
+		ca.readContextLength(ctx, provider, model)
+	}
+	return nil
+}
+
+// provisionModels makes the configured models available: it checks which
+// ones their servers have, pulls the missing Ollama models unless offline
+// mode is on, and prints the model report. In the background the pulls go on
+// after it returns, so the web server can start and show their progress.
+func (ca *CodeAssistant) provisionModels(ctx context.Context, background bool) error {
+	missing, err := ca.checkModels(ctx)
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 && ca.config.Offline {
+		return fmt.Errorf("offline mode is on and Ollama does not have %s; pull them with `ollama pull` or turn offline mode off", strings.Join(missing, ", "))
+	}
+	if len(missing) == 0 || !background {
+		err := ca.pullModels(ctx, missing)
+		fmt.Println(modelReport(ca.models.list()))
+		return err
+	}
+	go func() {
+		if err := ca.pullModels(ctx, missing); err != nil {
+			fmt.Printf("Error getting models: %v\n", err)
+		}
+		fmt.Println(modelReport(ca.models.list()))
+	}()
+	return nil
+}
+
+// modelReport describes the models, one line each.
+func modelReport(models []ModelStatus) string {
+	lines := []string{"Models:"}
+	for _, model := range models {
+		details := []string{model.Provider}
+		if model.Host != "" {
+			details = append(details, model.Host)
+		}
+		if model.Size > 0 {
+			details = append(details, formatBytes(model.Size))
+		}
+		if model.ContextLength > 0 {
+			details = append(details, fmt.Sprintf("context %d", model.ContextLength))
+		}
+		if model.Error != "" {
+			details = append(details, model.Error)
+		}
+		lines = append(lines, fmt.Sprintf("  %-28s %-26s %-10s %s", model.Name, strings.Join(model.Uses, ", "), model.State, strings.Join(details, ", ")))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// formatBytes formats a size in bytes with a decimal unit.
+func formatBytes(n int64) string {
+	const unit = 1000
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	size, exp := float64(n)/unit, 0
+	for size >= unit && exp < 3 {
+		size /= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", size, "kMGT"[exp])
+}
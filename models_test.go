@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestProvisionModels(t *testing.T) {
+	var ollama *fakeOllama
+	ca, _ := newFakeAssistant(t, func(t *testing.T, ca *CodeAssistant, provider *fakeProvider) {
+		ollama = newFakeOllama(t, ca, provider)
+	})
+	ollama.addModels("test-embed:latest") // Configured without its tag
+
+	if err := ca.provisionModels(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+	if pulls := ollama.pulls(); !slices.Equal(pulls, []string{"test-chat", "test-doc"}) {
+		t.Errorf("pulled %v, want the chat and documentation models", pulls)
+	}
+	for _, model := range ca.models.list() {
+		if model.State != ModelAvailable || model.ContextLength != fakeContextLength || model.Host != ollama.URL {
+			t.Errorf("got status %+v, want available with a context length", model)
+		}
+	}
+
+	// Models that are there are not pulled again
+	if err := ca.provisionModels(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+	if pulls := ollama.pulls(); len(pulls) != 2 {
+		t.Errorf("pulled %v on the second start", pulls)
+	}
+}
+
+func TestProvisionModelsOffline(t *testing.T) {
+	var ollama *fakeOllama
+	ca, _ := newFakeAssistant(t, func(t *testing.T, ca *CodeAssistant, provider *fakeProvider) {
+		ollama = newFakeOllama(t, ca, provider)
+	})
+	ollama.addModels("test-embed", "test-chat")
+	ca.config.Offline = true
+
+	err := ca.provisionModels(context.Background(), false)
+	if err == nil || !strings.Contains(err.Error(), "offline") || !strings.Contains(err.Error(), "test-doc") {
+		t.Fatalf("got %v, want an offline error naming the missing model", err)
+	}
+	if pulls := ollama.pulls(); len(pulls) != 0 {
+		t.Errorf("pulled %v in offline mode", pulls)
+	}
+}
+
+func TestProvisionModelsUnreachable(t *testing.T) {
+	ca, _ := newFakeAssistant(t, func(t *testing.T, ca *CodeAssistant, provider *fakeProvider) {
+		server := httptest.NewServer(nil)
+		server.Close()
+		ca.config.OllamaHost = server.URL
+	})
+
+	err := ca.provisionModels(context.Background(), false)
+	if err == nil || !strings.Contains(err.Error(), "cannot reach Ollama") {
+		t.Fatalf("got %v, want an unreachable error", err)
+	}
+}
+
+func TestProvisionExternalModels(t *testing.T) {
+	var ollama *fakeOllama
+	ca, _ := newFakeAssistant(t, func(t *testing.T, ca *CodeAssistant, provider *fakeProvider) {
+		ollama = newFakeOllama(t, ca, provider)
+		ca.config.ModelProviders = ProviderMap{"test-embed": {Type: ProviderHash}}
+	})
+	ollama.addModels("test-chat", "test-doc")
+
+	if err := ca.provisionModels(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+	models := ca.models.list()
+	if models[0].Name != "test-embed" || models[0].State != ModelExternal || models[0].Provider != ProviderHash {
+		t.Errorf("got status %+v, want the hash embedder as external", models[0])
+	}
+	if pulls := ollama.pulls(); len(pulls) != 0 {
+		t.Errorf("pulled %v, the models were there", pulls)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Role is what a user may do with a project. Each role includes the ones below it.
+type Role int
+
+const (
+	RoleNone       Role = iota
+	RoleViewer          // Chat and read docs
+	RoleMaintainer      // Index, reindex and review commits
+	RoleAdmin           // Delete the project and manage its members
+)
+
+// allProjects is the project name used for roles that apply to every project.
+// An admin of allProjects also manages users.
+const allProjects = "*"
+
+var roleNames = map[Role]string{
+	RoleNone:       "none",
+	RoleViewer:     "viewer",
+	RoleMaintainer: "maintainer",
+	RoleAdmin:      "admin",
+}
+
+func (r Role) String() string {
+	return roleNames[r]
+}
+
+// parseRole converts a role name from the CLI, API or database.
+func parseRole(name string) (Role, error) {
+	for role, roleName := range roleNames {
+		if role != RoleNone && roleName == name {
+			return role, nil
+		}
+	}
+	return RoleNone, fmt.Errorf("unknown role %q, expected viewer, maintainer or admin", name)
+}
+
+// UserRoles lists a user's roles keyed by project name
+type UserRoles struct {
+	Username string            `json:"username"`
+	Roles    map[string]string `json:"roles"`
+}
+
+// setRole grants a user a role on a project, or on every project when project is "*".
+func (ca *CodeAssistant) setRole(username, project string, role Role) error {
+	if project != allProjects && !validProjectName(project) {
+		return fmt.Errorf("invalid project name %q", project)
+	}
+	var exists bool
+	if err := ca.db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE username = ?)", username).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("user %s not found", username)
+	}
+	_, err := ca.db.Exec(`INSERT INTO project_roles (username, project, role, granted_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(username, project) DO UPDATE SET role = excluded.role, granted_at = excluded.granted_at`,
+		username, project, role.String(), time.Now())
+	return err
+}
+
+// removeRole takes away a user's role on a project.
+func (ca *CodeAssistant) removeRole(username, project string) error {
+	result, err := ca.db.Exec("DELETE FROM project_roles WHERE username = ? AND project = ?", username, project)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("user %s has no role on %s", username, project)
+	}
+	return nil
+}
+
+// userRoles returns the roles of every user, or of the members of one project
+// (including users with a role on every project) when project is not empty.
+func (ca *CodeAssistant) userRoles(project string) ([]UserRoles, error) {
+	query := "SELECT u.username, r.project, r.role FROM users u LEFT JOIN project_roles r ON r.username = u.username"
+	args := []interface{}{}
+	if project != "" {
+		query += " WHERE r.project IN (?, ?)"
+		args = append(args, project, allProjects)
+	}
+	rows, err := ca.db.Query(query+" ORDER BY u.username, r.project", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []UserRoles{}
+	for rows.Next() {
+		var username string
+		var projectName, role *string
+		if err := rows.Scan(&username, &projectName, &role); err != nil {
+			return nil, err
+		}
+		if len(users) == 0 || users[len(users)-1].Username != username {
+			users = append(users, UserRoles{Username: username, Roles: map[string]string{}})
+		}
+		if projectName != nil && role != nil {
+			users[len(users)-1].Roles[*projectName] = *role
+		}
+	}
+	return users, rows.Err()
+}
+
+// roleFor returns the caller's role on a project. Everyone is an admin when
+// auth is disabled, and so are API token callers and the local CLI user. A
+// context without a principal has no role at all.
+func (ca *CodeAssistant) roleFor(ctx context.Context, project string) (Role, error) {
+	if !ca.config.Auth.Enabled {
+		return RoleAdmin, nil
+	}
+	principal, ok := principalFromContext(ctx)
+	if !ok {
+		return RoleNone, nil
+	}
+	if principal.APIToken || principal.Local {
+		return RoleAdmin, nil
+	}
+
+	rows, err := ca.db.Query("SELECT role FROM project_roles WHERE username = ? AND project IN (?, ?)",
+		principal.Username, project, allProjects)
+	if err != nil {
+		return RoleNone, err
+	}
+	defer rows.Close()
+
+	best := RoleNone
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return RoleNone, err
+		}
+		if role, err := parseRole(name); err == nil && role > best {
+			best = role
+		}
+	}
+	return best, rows.Err()
+}
+
+// can reports whether the caller has at least role on project. Lookup errors deny access.
+func (ca *CodeAssistant) can(ctx context.Context, project string, role Role) bool {
+	have, err := ca.roleFor(ctx, project)
+	if err != nil {
+		fmt.Printf("Error checking role on %s: %v\n", project, err)
+		return false
+	}
+	return have >= role
+}
+
+// authorize writes a 403 response and returns false unless the caller has at
+// least role on project.
+func (ca *CodeAssistant) authorize(w http.ResponseWriter, r *http.Request, project string, role Role) bool {
+	if ca.can(r.Context(), project, role) {
+		return true
+	}
+	message := fmt.Sprintf("%s access to %s required", role, project)
+	if project == allProjects {
+		message = fmt.Sprintf("%s access to all projects required", role)
+	}
+	if isAPIRequest(r) {
+		writeAPIError(w, http.StatusForbidden, "forbidden", message)
+	} else {
+		http.Error(w, "Forbidden: "+message, http.StatusForbidden)
+	}
+	return false
+}
+
+// visibleProjects keeps the projects the caller has at least role on.
+func (ca *CodeAssistant) visibleProjects(ctx context.Context, projects []string, role Role) []string {
+	visible := []string{}
+	for _, project := range projects {
+		if ca.can(ctx, project, role) {
+			visible = append(visible, project)
+		}
+	}
+	return visible
+}
+
+// visibleJobs keeps the jobs of projects the caller may view.
+func (ca *CodeAssistant) visibleJobs(ctx context.Context, jobs []JobSnapshot) []JobSnapshot {
+	visible := []JobSnapshot{}
+	for _, job := range jobs {
+		if ca.can(ctx, job.Project, RoleViewer) {
+			visible = append(visible, job)
+		}
+	}
+	return visible
+}
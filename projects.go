@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ProjectStatus is the indexing state of a project
+type ProjectStatus string
+
+const (
+	ProjectNew         ProjectStatus = "new"         // Registered but never indexed
+	ProjectIndexing    ProjectStatus = "indexing"    // An indexing run is in progress
+	ProjectIndexed     ProjectStatus = "indexed"     // The last run completed
+	ProjectInterrupted ProjectStatus = "interrupted" // The last run was stopped, rerun to resume
+	ProjectFailed      ProjectStatus = "failed"      // The last run failed
+)
+
+const projectColumns = `name, path, exclude_folders, exclude_files, retrieval, status,
+	total_indexed_files, total_failed_files, pending_embedding, pending_files, created_at, last_updated`
+
+// loadProjectConfig loads a project from the database. It returns an empty
+// config when the project does not exist.
+func (ca *CodeAssistant) loadProjectConfig(projectName string) (ProjectConfig, error) {
+	config, err := readProject(ca.db, projectName)
+	if err == sql.ErrNoRows {
+		return ProjectConfig{}, nil
+	}
+	return config, err
+}
+
+// saveProjectConfig creates a project or replaces all of its fields.
+func (ca *CodeAssistant) saveProjectConfig(config ProjectConfig) error {
+	return writeProject(ca.db, config)
+}
+
+// updateProject changes fields of an existing project in one transaction, so
+// indexing progress and settings edited through the API do not overwrite
+// each other.
+func (ca *CodeAssistant) updateProject(projectName string, update func(config *ProjectConfig)) error {
+	tx, err := ca.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	config, err := readProject(tx, projectName)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("project %s not found", projectName)
+	} else if err != nil {
+		return err
+	}
+	update(&config)
+	if err := writeProject(tx, config); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// listProjects returns the registered projects that the caller may view.
+func (ca *CodeAssistant) listProjects(ctx context.Context) ([]string, error) {
+	rows, err := ca.db.Query("SELECT name FROM projects ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var projects []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		projects = append(projects, name)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return ca.visibleProjects(ctx, projects, RoleViewer), nil
+}
+
+// readProject loads one project with db, which may be a transaction.
+func readProject(db interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}, projectName string) (ProjectConfig, error) {
+	var config ProjectConfig
+	var excludeFolders, excludeFiles, retrieval, pendingFiles string
+	var lastUpdated sql.NullTime
+	err := db.QueryRow("SELECT "+projectColumns+" FROM projects WHERE name = ?", projectName).Scan(
+		&config.ProjectName, &config.ProjectPath, &excludeFolders, &excludeFiles, &retrieval, &config.Status,
+		&config.TotalIndexedFiles, &config.TotalFailedFiles, &config.PendingEmbedding, &pendingFiles, &config.CreatedAt, &lastUpdated)
+	if err != nil {
+		return ProjectConfig{}, err
+	}
+	config.LastUpdated = lastUpdated.Time
+
+	for _, field := range []struct {
+		column string
+		value  interface{}
+	}{
+		{excludeFolders, &config.ExcludeFolders},
+		{excludeFiles, &config.ExcludeFiles},
+		{retrieval, &config.Retrieval},
+		{pendingFiles, &config.PendingFiles},
+	} {
+		if err := json.Unmarshal([]byte(field.column), field.value); err != nil {
+			return ProjectConfig{}, fmt.Errorf("invalid settings stored for project %s: %v", projectName, err)
+		}
+	}
+	return config, nil
+}
+
+// writeProject inserts or replaces a project with db, which may be a transaction.
+func writeProject(db interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}, config ProjectConfig) error {
+	if config.Status == "" {
+		config.Status = ProjectNew
+	}
+	if config.CreatedAt.IsZero() {
+		config.CreatedAt = time.Now()
+	}
+	var encoded [4][]byte
+	for i, value := range []interface{}{config.ExcludeFolders, config.ExcludeFiles, config.Retrieval, config.PendingFiles} {
+		var err error
+		if encoded[i], err = json.Marshal(value); err != nil {
+			return err
+		}
+	}
+	var lastUpdated sql.NullTime
+	if !config.LastUpdated.IsZero() {
+		lastUpdated = sql.NullTime{Time: config.LastUpdated, Valid: true}
+	}
+
+	_, err := db.Exec(`INSERT INTO projects (`+projectColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(name) DO UPDATE SET path = excluded.path, exclude_folders = excluded.exclude_folders,
+			exclude_files = excluded.exclude_files, retrieval = excluded.retrieval, status = excluded.status,
+			total_indexed_files = excluded.total_indexed_files, total_failed_files = excluded.total_failed_files,
+			pending_embedding = excluded.pending_embedding, pending_files = excluded.pending_files,
+			last_updated = excluded.last_updated`,
+		config.ProjectName, config.ProjectPath, string(encoded[0]), string(encoded[1]), string(encoded[2]), config.Status,
+		config.TotalIndexedFiles, config.TotalFailedFiles, config.PendingEmbedding, string(encoded[3]), config.CreatedAt, lastUpdated)
+	if err != nil {
+		return fmt.Errorf("failed to save project %s: %v", config.ProjectName, err)
+	}
+	return nil
+}
+
+// readProjectConfigFile reads the project_config.json that older versions
+// kept in each project's docs folder.
+func readProjectConfigFile(docsDir, projectName string) (ProjectConfig, error) {
+	var config ProjectConfig
+	content, err := ioutil.ReadFile(filepath.Join(docsDir, projectName, "project_config.json"))
+	if err != nil {
+		return ProjectConfig{}, err
+	}
+	if err := json.Unmarshal(content, &config); err != nil {
+		return ProjectConfig{}, err
+	}
+	return config, nil
+}
+
+// importProjectConfigs registers the projects of older versions from the
+// project_config.json files in DocsDir. Folders without one are not projects.
+// The files are left in place but no longer read.
+func (ca *CodeAssistant) importProjectConfigs(tx *sql.Tx) error {
+	entries, err := os.ReadDir(ca.config.DocsDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	imported := 0
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		config, err := readProjectConfigFile(ca.config.DocsDir, entry.Name())
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			fmt.Printf("Skipping project %s, its config could not be read: %v\n", entry.Name(), err)
+			continue
+		}
+		if config.ProjectPath == "" || !validProjectName(entry.Name()) {
+			continue
+		}
+		// The docs folder is what the rest of CodeSage knows the project by
+		config.ProjectName = entry.Name()
+		config.Status = ProjectNew
+		if !config.LastUpdated.IsZero() {
+			config.Status = ProjectIndexed
+			config.CreatedAt = config.LastUpdated
+		}
+		if config.PendingEmbedding || len(config.PendingFiles) > 0 {
+			config.Status = ProjectInterrupted
+		}
+		if err := writeProject(tx, config); err != nil {
+			return err
+		}
+		imported++
+	}
+	if imported > 0 {
+		fmt.Printf("Imported %d projects from %s\n", imported, ca.config.DocsDir)
+	}
+	return nil
+}
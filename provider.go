@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+)
+
+// Provider types for ProviderConfig.Type
+const (
+	ProviderOllama = "ollama"
+	ProviderOpenAI = "openai" // OpenAI-compatible servers such as llama.cpp and vLLM
+	ProviderHash   = "hash"   // Local embeddings from hashed words, for tests and offline use
+)
+
+// ProviderConfig selects the API that serves a model. Models without one are
+// served by Ollama at Config.OllamaHost.
+type ProviderConfig struct {
+	Type    string `json:"type"`               // ollama, openai or hash (embedding models only), defaults to ollama
+	BaseURL string `json:"base_url,omitempty"` // e.g. http://localhost:8000/v1, defaults to ollama_host for Ollama
+	APIKey  string `json:"api_key,omitempty"`  // Sent as a bearer token
+}
+
+// ProviderMap holds the provider of each model by model name
+type ProviderMap map[string]ProviderConfig
+
+// Message is one turn of a conversation sent to a chat model
+type Message struct {
+	Role    string `json:"role"` // system, user or assistant
+	Content string `json:"content"`
+}
+
+// ChatRequest asks a chat model to continue a conversation
+type ChatRequest struct {
+	Model         string
+	Messages      []Message
+	ContextWindow int // Tokens to run the model with, only Ollama sets it per request
+}
+
+// ChatProvider generates answers with the chat models of one server.
+type ChatProvider interface {
+	// Chat passes the answer to onToken as it is generated. An error
+	// returned by onToken aborts the request.
+	Chat(ctx context.Context, req ChatRequest, onToken func(string) error) error
+	// ContextLength returns the context length model was trained with.
+	ContextLength(ctx context.Context, model string) (int, error)
+}
+
+// providerStatusError is an HTTP error response from a provider
+type providerStatusError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e providerStatusError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// setProvider serves model with provider, a ChatProvider, an
+// EmbeddingProvider or both, instead of the configured provider. It is meant
+// for tests and must be called before the assistant is used.
+func (ca *CodeAssistant) setProvider(model string, provider interface{}) {
+	if ca.providers == nil {
+		ca.providers = map[string]interface{}{}
+	}
+	ca.providers[model] = provider
+}
+
+// chatProvider returns the provider configured for model.
+func (ca *CodeAssistant) chatProvider(model string) (ChatProvider, error) {
+	if provider, ok := ca.providers[model].(ChatProvider); ok {
+		return provider, nil
+	}
+	config := ca.config.ModelProviders[model]
+	switch config.Type {
+	case "", ProviderOllama:
+		return ca.newOllamaProvider(config)
+	case ProviderOpenAI:
+		return newOpenAIProvider(model, config)
+	default:
+		return nil, fmt.Errorf("model %s has provider type %q, which cannot chat", model, config.Type)
+	}
+}
+
+// ollamaProvider serves models through the Ollama API
+type ollamaProvider struct {
+	client *api.Client
+}
+
+// newOllamaProvider connects to the Ollama server of config, which defaults
+// to Config.OllamaHost and then to OLLAMA_HOST.
+func (ca *CodeAssistant) newOllamaProvider(config ProviderConfig) (*ollamaProvider, error) {
+	baseURL := config.BaseURL
+	if baseURL == "" {
+		baseURL = ca.config.OllamaHost
+	}
+	u := envconfig.Host()
+	if baseURL != "" {
+		var err error
+		if u, err = url.Parse(baseURL); err != nil {
+			return nil, fmt.Errorf("invalid Ollama host %q: %v", baseURL, err)
+		}
+	}
+	return &ollamaProvider{client: api.NewClient(u, ollamaHTTPClient)}, nil
+}
+
+// ollamaHTTPClient records the status of Ollama's responses, see
+// responseStatus
+var ollamaHTTPClient = &http.Client{Transport: statusTransport{http.DefaultTransport}}
+
+// responseStatusKey is the context key of the *int statusTransport stores the
+// response status in
+type responseStatusKey struct{}
+
+// statusTransport stores the status of each response in the request context.
+// Ollama's client reports an error body of a streamed response as a plain
+// error, without the status that tells an overloaded server from a bad
+// request.
+type statusTransport struct {
+	base http.RoundTripper
+}
+
+func (t statusTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if status, ok := req.Context().Value(responseStatusKey{}).(*int); ok && resp != nil {
+		*status = resp.StatusCode
+	}
+	return resp, err
+}
+
+// responseStatus returns a context under which the status of the Ollama
+// response is stored in status.
+func responseStatus(ctx context.Context, status *int) context.Context {
+	return context.WithValue(ctx, responseStatusKey{}, status)
+}
+
+func (p *ollamaProvider) Chat(ctx context.Context, req ChatRequest, onToken func(string) error) error {
+	chatReq := &api.ChatRequest{Model: req.Model}
+	for _, message := range req.Messages {
+		chatReq.Messages = append(chatReq.Messages, api.Message{Role: message.Role, Content: message.Content})
+	}
+	if req.ContextWindow > 0 {
+		chatReq.Options = map[string]interface{}{"num_ctx": req.ContextWindow}
+	}
+	status := 0
+	err := p.client.Chat(responseStatus(ctx, &status), chatReq, func(resp api.ChatResponse) error {
+		if resp.Message.Content == "" {
+			return nil
+		}
+		return onToken(resp.Message.Content)
+	})
+	var statusErr api.StatusError
+	if err != nil && status >= http.StatusBadRequest && !errors.As(err, &statusErr) {
+		return providerStatusError{StatusCode: status, Message: err.Error()}
+	}
+	return err
+}
+
+func (p *ollamaProvider) ContextLength(ctx context.Context, model string) (int, error) {
+	resp, err := p.client.Show(ctx, &api.ShowRequest{Model: model})
+	if err != nil {
+		return 0, err
+	}
+	for key, value := range resp.ModelInfo {
+		if length, ok := value.(float64); ok && strings.HasSuffix(key, ".context_length") {
+			return int(length), nil
+		}
+	}
+	return 0, fmt.Errorf("model %s does not report its context length", model)
+}
+
+// openAIProvider serves models through an OpenAI-compatible API, as offered by
+// llama.cpp's server and vLLM. baseURL includes the /v1 prefix.
+type openAIProvider struct {
+	baseURL string
+	apiKey  string
+	client  *http.Client
+}
+
+// newOpenAIProvider connects to the OpenAI-compatible server of config.
+func newOpenAIProvider(model string, config ProviderConfig) (*openAIProvider, error) {
+	if config.BaseURL == "" {
+		return nil, fmt.Errorf("model %s has no base_url for its openai provider", model)
+	}
+	return &openAIProvider{baseURL: strings.TrimSuffix(config.BaseURL, "/"), apiKey: config.APIKey, client: http.DefaultClient}, nil
+}
+
+// do sends a request to the API and returns the response, or an error for a
+// non-2xx status.
+func (p *openAIProvider) do(ctx context.Context, method, path string, body interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, p.baseURL+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+p.apiKey)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, providerStatusError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(message))}
+	}
+	return resp, nil
+}
+
+func (p *openAIProvider) Chat(ctx context.Context, req ChatRequest, onToken func(string) error) error {
+	resp, err := p.do(ctx, http.MethodPost, "/chat/completions", map[string]interface{}{
+		"model":    req.Model,
+		"messages": req.Messages,
+		"stream":   true,
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// The answer is streamed as server-sent events, one JSON chunk per event
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			continue
+		}
+		data = strings.TrimSpace(data)
+		if data == "[DONE]" {
+			return nil
+		}
+		var chunk struct {
+			Choices []struct {
+				Delta struct {
+					Content string `json:"content"`
+				} `json:"delta"`
+			} `json:"choices"`
+			Error *struct {
+				Message string      `json:"message"`
+				Code    interface{} `json:"code"` // The HTTP status on llama.cpp and vLLM
+			} `json:"error"`
+		}
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return fmt.Errorf("invalid response chunk: %v", err)
+		}
+		if chunk.Error != nil {
+			status := resp.StatusCode
+			if code, ok := chunk.Error.Code.(float64); ok && code >= http.StatusBadRequest {
+				status = int(code)
+			}
+			return providerStatusError{StatusCode: status, Message: chunk.Error.Message}
+		}
+		for _, choice := range chunk.Choices {
+			if choice.Delta.Content == "" {
+				continue
+			}
+			if err := onToken(choice.Delta.Content); err != nil {
+				return err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return io.ErrUnexpectedEOF // The stream ended without [DONE]
+}
+
+// ContextLength reads the model's context length from the model list, where
+// vLLM reports max_model_len and llama.cpp n_ctx_train.
+func (p *openAIProvider) ContextLength(ctx context.Context, model string) (int, error) {
+	resp, err := p.do(ctx, http.MethodGet, "/models", nil)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	var list struct {
+		Data []struct {
+			ID          string `json:"id"`
+			MaxModelLen int    `json:"max_model_len"`
+			Meta        struct {
+				NCtxTrain int `json:"n_ctx_train"`
+			} `json:"meta"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return 0, fmt.Errorf("invalid model list: %v", err)
+	}
+	for _, m := range list.Data {
+		// llama.cpp serves a single model, named after its file
+		if m.ID != model && len(list.Data) > 1 {
+			continue
+		}
+		if length := max(m.MaxModelLen, m.Meta.NCtxTrain); length > 0 {
+			return length, nil
+		}
+	}
+	return 0, fmt.Errorf("model %s does not report its context length", model)
+}
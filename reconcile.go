@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// reconcileFiles handles the files that were indexed before but are no longer
+// in the codebase. A new file with the same content as a removed one is
+// treated as a rename: its generated doc is moved instead of regenerated. The
+// docs and hash rows of the other removed files are deleted. Every affected
+// path is added to the project's pending files so its vector entries follow.
+func (ca *CodeAssistant) reconcileFiles(project *ProjectConfig, codebasePath string, files []string) (removed, renamed int, err error) {
+	projectName := project.ProjectName
+	tracked, err := ca.projectFileHashes(projectName)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to load file hashes: %v", err)
+	}
+
+	current := make(map[string]string, len(files)) // Relative path to full path
+	for _, file := range files {
+		if relPath, err := filepath.Rel(codebasePath, file); err == nil {
+			current[relPath] = file
+		}
+	}
+	// Removed files by content hash, to match them with new files
+	removedByHash := map[string][]string{}
+	for relPath, hash := range tracked {
+		if _, ok := current[relPath]; !ok {
+			removedByHash[hash.ContentHash] = append(removedByHash[hash.ContentHash], relPath)
+		}
+	}
+	if len(removedByHash) == 0 {
+		return 0, 0, nil
+	}
+
+	for relPath, file := range current {
+		if _, ok := tracked[relPath]; ok {
+			continue
+		}
+		contentHash, err := calculateSHA256Hash(file)
+		if err != nil {
+			// indexProject reports the file when it gets to it
+			continue
+		}
+		candidates := removedByHash[contentHash]
+		if len(candidates) == 0 {
+			continue
+		}
+		oldRel := candidates[0]
+		if err := ca.moveFileDoc(project, oldRel, relPath, tracked[oldRel]); err != nil {
+			fmt.Printf("Error moving doc of %s to %s, it will be regenerated: %v\n", oldRel, relPath, err)
+			continue
+		}
+		removedByHash[contentHash] = candidates[1:]
+		renamed++
+	}
+
+	for _, oldRels := range removedByHash {
+		for _, oldRel := range oldRels {
+			if err := ca.removeFileDoc(project, oldRel); err != nil {
+				return removed, renamed, err
+			}
+			fmt.Printf("Removed %s\n", oldRel)
+			removed++
+		}
+	}
+	return removed, renamed, nil
+}
+
+// moveFileDoc moves the generated doc and hash of a renamed file. The hash
+// keeps the model and prompt version the doc was generated with.
+func (ca *CodeAssistant) moveFileDoc(project *ProjectConfig, oldRel, newRel string, hash FileHash) error {
+	projectName := project.ProjectName
+	projectDocsDir := filepath.Join(ca.config.DocsDir, projectName)
+	oldDoc := filepath.Join(projectDocsDir, oldRel+".txt")
+	newDoc := filepath.Join(projectDocsDir, newRel+".txt")
+
+	content, err := ioutil.ReadFile(oldDoc)
+	if err != nil {
+		return err
+	}
+	// Docs start with the file they describe
+	doc := string(content)
+	if header := fmt.Sprintf("File: %s\n", oldRel); strings.HasPrefix(doc, header) {
+		doc = fmt.Sprintf("File: %s\n", newRel) + strings.TrimPrefix(doc, header)
+	}
+	if err := os.MkdirAll(filepath.Dir(newDoc), os.ModePerm); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(newDoc, []byte(doc), 0644); err != nil {
+		return err
+	}
+	if err := ca.setFileHash(projectName, newRel, hash); err != nil {
+		return err
+	}
+	if err := ca.removeFileDoc(project, oldRel); err != nil {
+		return err
+	}
+	fmt.Printf("Renamed %s to %s\n", oldRel, newRel)
+	project.PendingFiles = addPendingFile(project.PendingFiles, newRel)
+	return nil
+}
+
+// removeFileDoc deletes the generated doc and hash of a removed file.
+func (ca *CodeAssistant) removeFileDoc(project *ProjectConfig, relPath string) error {
+	projectName := project.ProjectName
+	projectDocsDir := filepath.Join(ca.config.DocsDir, projectName)
+	docPath := filepath.Join(projectDocsDir, relPath+".txt")
+	if err := os.Remove(docPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete doc of %s: %v", relPath, err)
+	}
+	// Drop directories left empty, up to the project's docs dir
+	for dir := filepath.Dir(docPath); dir != projectDocsDir && strings.HasPrefix(dir, projectDocsDir); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	if _, err := ca.db.Exec("DELETE FROM file_hashes WHERE project = ? AND rel_path = ?", projectName, relPath); err != nil {
+		return fmt.Errorf("failed to delete file hash of %s: %v", relPath, err)
+	}
+	// The doc is gone, so embedding the file removes its vector entries
+	project.PendingFiles = addPendingFile(project.PendingFiles, relPath)
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// errProjectBusy is returned when a project is already being indexed or deleted
+var errProjectBusy = errors.New("project is busy")
+
+// projectRegistry hands out per-project locks. Only one index run, reindex
+// or delete may hold a project at a time, and it never blocks readers. Each
+// project's vector collection has its own RWMutex: queries hold it for
+// reading while collection contents are swapped under the write lock, so
+// indexing one project never blocks questions about another.
+type projectRegistry struct {
+	mu      sync.Mutex
+	busy    map[string]string // Project name to what holds it
+	vectors map[string]*sync.RWMutex
+}
+
+// newProjectRegistry creates an empty registry
+func newProjectRegistry() *projectRegistry {
+	return &projectRegistry{busy: map[string]string{}, vectors: map[string]*sync.RWMutex{}}
+}
+
+// lock reserves a project for an operation such as "indexing", or fails with
+// errProjectBusy when another one holds it. The returned func releases it.
+func (r *projectRegistry) lock(project, operation string) (func(), error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if holder, ok := r.busy[project]; ok {
+		return nil, fmt.Errorf("%w: %s is already %s", errProjectBusy, project, holder)
+	}
+	r.busy[project] = operation
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			r.mu.Lock()
+			delete(r.busy, project)
+			r.mu.Unlock()
+		})
+	}, nil
+}
+
+// vectorLock returns the lock guarding a project's vector collection.
+func (r *projectRegistry) vectorLock(project string) *sync.RWMutex {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	lock, ok := r.vectors[project]
+	if !ok {
+		lock = &sync.RWMutex{}
+		r.vectors[project] = lock
+	}
+	return lock
+}
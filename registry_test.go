@@ -0,0 +1,476 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/philippgille/chromem-go"
+)
+
+// newTestAssistant returns an assistant with a migrated SQLite database and an
+// in-memory vector DB in a temporary directory. Auth is disabled.
+func newTestAssistant(t *testing.T) *CodeAssistant {
+	t.Helper()
+	dir := t.TempDir()
+	config := Config{
+		SQLiteDBPath:   filepath.Join(dir, "codesage.db"),
+		DocsDir:        filepath.Join(dir, "docs"),
+		EmbeddingModel: "test-embed",
+	}
+	ca, err := openDatabase(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.vectorDB.Store(chromem.NewDB())
+	if _, err := ca.migrateDatabase(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ca.stop()
+		ca.db.Close()
+	})
+	return ca
+}
+
+func TestProjectRegistryLock(t *testing.T) {
+	registry := newProjectRegistry()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var unlocks []func()
+	busy := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock, err := registry.lock("demo", "indexing")
+			mu.Lock()
+			defer mu.Unlock()
+			if errors.Is(err, errProjectBusy) {
+				busy++
+			} else if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			} else {
+				unlocks = append(unlocks, unlock)
+			}
+		}()
+	}
+	wg.Wait()
+	if len(unlocks) != 1 || busy != 19 {
+		t.Fatalf("got %d holders and %d busy, want 1 and 19", len(unlocks), busy)
+	}
+
+	// Other projects are independent
+	unlockOther, err := registry.lock("other", "indexing")
+	if err != nil {
+		t.Fatalf("locking another project: %v", err)
+	}
+	unlockOther()
+
+	unlocks[0]()
+	unlocks[0]() // Releasing twice must not free a later holder's lock
+	unlock, err := registry.lock("demo", "being deleted")
+	if err != nil {
+		t.Fatalf("locking after release: %v", err)
+	}
+	if _, err := registry.lock("demo", "indexing"); err == nil || !strings.Contains(err.Error(), "being deleted") {
+		t.Fatalf("got %v, want the holder in the error", err)
+	}
+	unlock()
+}
+
+func TestConcurrentProjectHandlers(t *testing.T) {
+	ca := newTestAssistant(t)
+	codebase := t.TempDir()
+	for _, name := range []string{"alpha", "beta"} {
+		if err := ca.saveProjectConfig(ProjectConfig{ProjectName: name, ProjectPath: codebase}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	handler := ca.newWebServer().Handler
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(4)
+		go func() {
+			defer wg.Done()
+			if rec := do(http.MethodGet, "/api/v1/projects", ""); rec.Code != http.StatusOK {
+				t.Errorf("list: %d %s", rec.Code, rec.Body)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if rec := do(http.MethodGet, "/api/v1/projects/alpha", ""); rec.Code != http.StatusOK {
+				t.Errorf("get: %d %s", rec.Code, rec.Body)
+			}
+		}()
+		go func(i int) {
+			defer wg.Done()
+			body := fmt.Sprintf(`{"retrieval": {"top_k": %d}}`, i+1)
+			if rec := do(http.MethodPatch, "/api/v1/projects/alpha", body); rec.Code != http.StatusOK {
+				t.Errorf("patch: %d %s", rec.Code, rec.Body)
+			}
+		}(i)
+		// What an index run saves between files
+		go func(i int) {
+			defer wg.Done()
+			err := ca.updateProject("alpha", func(config *ProjectConfig) {
+				config.Status = ProjectIndexing
+				config.PendingFiles = addPendingFile(config.PendingFiles, fmt.Sprintf("file%d.go", i))
+			})
+			if err != nil {
+				t.Errorf("update: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	config, err := ca.loadProjectConfig("alpha")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.PendingFiles) != 8 {
+		t.Errorf("got pending files %v, want 8: settings updates overwrote index progress", config.PendingFiles)
+	}
+	if config.Retrieval.TopK == 0 {
+		t.Errorf("retrieval settings were lost")
+	}
+}
+
+func TestQueryDuringVectorUpdate(t *testing.T) {
+	ca := newTestAssistant(t)
+	newFakeOllama(t, ca, newFakeProvider())
+	ctx := context.Background()
+
+	docsDir := filepath.Join(ca.config.DocsDir, "demo")
+	if err := os.MkdirAll(docsDir, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	var relPaths []string
+	for i := 0; i < 5; i++ {
+		relPath := fmt.Sprintf("file%d.go", i)
+		relPaths = append(relPaths, relPath)
+		doc := fmt.Sprintf("File: %s\nfunc F%d() handles request %d\n", relPath, i, i)
+		if err := os.WriteFile(filepath.Join(docsDir, relPath+".txt"), []byte(doc), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ca.createVectorStore(ctx, nil, "demo", t.TempDir(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				results, err := ca.queryVectorStore(ctx, "demo", "which function handles requests", 3)
+				if err != nil {
+					t.Errorf("query: %v", err)
+					return
+				}
+				if len(results) == 0 {
+					t.Errorf("query returned no results while the collection was updated")
+					return
+				}
+			}
+		}()
+		go func(i int) {
+			defer wg.Done()
+			if err := ca.updateVectorStore(ctx, nil, "demo", "", relPaths[i:i+1], nil); err != nil {
+				t.Errorf("update: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	collec, _ := ca.projectCollection(ca.vectorDB.Load(), "demo")
+	if collec == nil || collec.Count() != len(relPaths) {
+		t.Fatalf("collection has the wrong number of chunks after concurrent updates")
+	}
+}
+
+func TestRebuildKeepsCollectionUntilComplete(t *testing.T) {
+	ca := newTestAssistant(t)
+	ollama := newFakeOllama(t, ca, newFakeProvider())
+	ctx := context.Background()
+
+	docsDir := filepath.Join(ca.config.DocsDir, "demo")
+	if err := os.MkdirAll(docsDir, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	writeDoc := func(i int) {
+		relPath := fmt.Sprintf("file%d.go", i)
+		doc := fmt.Sprintf("File: %s\nfunc F%d() handles request %d\n", relPath, i, i)
+		if err := os.WriteFile(filepath.Join(docsDir, relPath+".txt"), []byte(doc), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	count := func() int {
+		collec, err := ca.projectCollection(ca.vectorDB.Load(), "demo")
+		if err != nil || collec == nil {
+			t.Fatalf("the project has no collection: %v", err)
+		}
+		return collec.Count()
+	}
+	for i := 0; i < 3; i++ {
+		writeDoc(i)
+	}
+	if err := ca.createVectorStore(ctx, nil, "demo", t.TempDir(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// A rebuild that fails leaves the old collection searchable
+	writeDoc(3)
+	ca.config.LLM = LLMConfig{MaxRetries: -1}
+	ca.llmBreaker = newCircuitBreaker(ca.config.LLM)
+	ollama.failNext(1)
+	if err := ca.createVectorStore(ctx, nil, "demo", t.TempDir(), nil); err == nil {
+		t.Fatal("the rebuild succeeded while Ollama failed")
+	}
+	if n := count(); n != 3 {
+		t.Errorf("collection has %d chunks after a failed rebuild, want the old 3", n)
+	}
+	if results, err := ca.queryVectorStore(ctx, "demo", "which function handles requests", 3); err != nil || len(results) == 0 {
+		t.Errorf("query after a failed rebuild returned %d results, %v", len(results), err)
+	}
+
+	// So does one stopped while the embedded chunks are added
+	relPaths := []string{"file0.go", "file1.go", "file2.go", "file3.go"}
+	documents, err := ca.embedFileDocs(ctx, nil, "demo", "", relPaths, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	embedded := map[string][]chromem.Document{}
+	for _, doc := range documents {
+		embedded[doc.Metadata["rel_path"]] = append(embedded[doc.Metadata["rel_path"]], doc)
+	}
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := ca.createVectorStore(canceled, nil, "demo", t.TempDir(), embedded); err == nil {
+		t.Fatal("the rebuild succeeded after it was canceled")
+	}
+	if n := count(); n != 3 {
+		t.Errorf("collection has %d chunks after a canceled rebuild, want the old 3", n)
+	}
+
+	// A complete rebuild is swapped in and the old collection dropped
+	if err := ca.createVectorStore(ctx, nil, "demo", t.TempDir(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(); n != 4 {
+		t.Errorf("collection has %d chunks after the rebuild, want 4", n)
+	}
+	owned := 0
+	for name := range ca.vectorDB.Load().ListCollections() {
+		if ownsCollection("demo", name) {
+			owned++
+		}
+	}
+	if owned != 1 {
+		t.Errorf("the project has %d collections after the rebuild, want 1", owned)
+	}
+}
+
+func TestIndexJobsRefuseBusyProject(t *testing.T) {
+	ca := newTestAssistant(t)
+	codebase := t.TempDir()
+	if err := ca.saveProjectConfig(ProjectConfig{ProjectName: "demo", ProjectPath: codebase}); err != nil {
+		t.Fatal(err)
+	}
+	unlock, err := ca.registry.lock("demo", "indexing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+
+	if _, err := ca.startReindexJob("demo", ReindexOptions{}); !errors.Is(err, errProjectBusy) {
+		t.Errorf("startReindexJob: got %v, want errProjectBusy", err)
+	}
+	if _, err := ca.reindexProject(nil, "demo", ReindexOptions{Wipe: true}); !errors.Is(err, errProjectBusy) {
+		t.Errorf("reindexProject: got %v, want errProjectBusy", err)
+	}
+
+	handler := ca.newWebServer().Handler
+	for _, tc := range []struct{ method, path string }{
+		{http.MethodPost, "/api/v1/projects/demo/index"},
+		{http.MethodPost, "/api/v1/projects/demo/reindex?wipe=true"},
+		{http.MethodDelete, "/api/v1/projects/demo"},
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(tc.method, tc.path, nil))
+		if rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), "project_busy") {
+			t.Errorf("%s %s: got %d %s, want 409 project_busy", tc.method, tc.path, rec.Code, rec.Body)
+		}
+	}
+	if config, _ := ca.loadProjectConfig("demo"); config.ProjectName == "" {
+		t.Errorf("busy project was deleted")
+	}
+}
+
+func TestDeleteProject(t *testing.T) {
+	ca := newTestAssistant(t)
+	if err := ca.saveProjectConfig(ProjectConfig{ProjectName: "alpha", ProjectPath: t.TempDir()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ca.createUser("alice", "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ca.setRole("alice", "alpha", RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	docs := filepath.Join(ca.config.DocsDir, "alpha")
+	if err := os.MkdirAll(docs, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := ca.loadProjectConfig("alpha")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ca.deleteProject(config); err != nil {
+		t.Fatal(err)
+	}
+	if config, err := ca.loadProjectConfig("alpha"); err != nil || config.ProjectName != "" {
+		t.Errorf("the project was kept: %+v, %v", config, err)
+	}
+	if _, err := os.Stat(docs); !os.IsNotExist(err) {
+		t.Errorf("the docs were kept")
+	}
+	// A new project with the same name does not inherit the old grants
+	if users, _ := ca.userRoles("alpha"); len(users) != 0 {
+		t.Errorf("roles were kept: %+v", users)
+	}
+}
+
+func TestIndexJobRefusesExistingProject(t *testing.T) {
+	ca := newTestAssistant(t)
+	codebase := t.TempDir()
+	if err := ca.saveProjectConfig(ProjectConfig{ProjectName: "demo", ProjectPath: codebase}); err != nil {
+		t.Fatal(err)
+	}
+
+	form := url.Values{"project_name": {"demo"}, "kind": {"index"}, "project_path": {t.TempDir()}}
+	req := httptest.NewRequest(http.MethodPost, "/jobs", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	ca.newWebServer().Handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), "project_exists") {
+		t.Errorf("got %d %s, want 409 project_exists", rec.Code, rec.Body)
+	}
+	if config, _ := ca.loadProjectConfig("demo"); config.ProjectPath != codebase {
+		t.Errorf("the project now points at %s", config.ProjectPath)
+	}
+}
+
+func TestCloseRefusesNewIndexRuns(t *testing.T) {
+	ca := newTestAssistant(t)
+	if err := ca.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ca.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+	_, err := ca.indexProject(context.Background(), nil, "demo", t.TempDir(), nil, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want the run refused with context.Canceled", err)
+	}
+}
+
+func TestIndexLeaseAcrossProcesses(t *testing.T) {
+	ca := newTestAssistant(t)
+	// Another process using the same database
+	other, err := openDatabase(ca.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.db.Close()
+
+	release, err := other.leaseProject("demo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ca.indexProject(context.Background(), nil, "demo", t.TempDir(), nil, nil)
+	if !errors.Is(err, errProjectBusy) {
+		t.Errorf("got %v while another process indexes, want errProjectBusy", err)
+	}
+	release()
+	if release, err = ca.leaseProject("demo"); err != nil {
+		t.Fatalf("lease after release: %v", err)
+	}
+	release()
+
+	// The lease of a process that died expires
+	stale, err := other.leaseProject("demo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stale()
+	if _, err := ca.db.Exec("UPDATE index_leases SET heartbeat_at = ?", time.Now().Add(-indexLeaseTimeout)); err != nil {
+		t.Fatal(err)
+	}
+	if release, err = ca.leaseProject("demo"); err != nil {
+		t.Errorf("expired lease: %v", err)
+	} else {
+		release()
+	}
+}
+
+func TestCompletedRunPrunesJournal(t *testing.T) {
+	ca := newTestAssistant(t)
+	runCount := func(project string) (runs, files int) {
+		ca.db.QueryRow("SELECT COUNT(*) FROM index_runs WHERE project = ?", project).Scan(&runs)
+		ca.db.QueryRow("SELECT COUNT(*) FROM index_run_files WHERE run_id IN (SELECT id FROM index_runs WHERE project = ?)", project).Scan(&files)
+		return runs, files
+	}
+	run := func(project string, status RunStatus) int64 {
+		runID, err := ca.startIndexRun(project, []string{"a.go", "b.go"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ca.finishIndexRun(runID, status); err != nil {
+			t.Fatal(err)
+		}
+		return runID
+	}
+
+	run("other", RunCompleted)
+	run("demo", RunCompleted)
+	run("demo", RunFailed)
+	run("demo", RunInterrupted)
+	if runs, _ := runCount("demo"); runs != 3 {
+		t.Fatalf("got %d runs before one completed, want 3", runs)
+	}
+
+	// Completing a run drops the project's earlier runs, not other projects'
+	latest := run("demo", RunCompleted)
+	if runs, files := runCount("demo"); runs != 1 || files != 2 {
+		t.Errorf("got %d runs with %d files after a run completed, want only the latest", runs, files)
+	}
+	var id int64
+	if err := ca.db.QueryRow("SELECT id FROM index_runs WHERE project = ?", "demo").Scan(&id); err != nil || id != latest {
+		t.Errorf("kept run %d, %v, want the latest %d", id, err, latest)
+	}
+	if runs, files := runCount("other"); runs != 1 || files != 2 {
+		t.Errorf("another project has %d runs with %d files, want 1 with 2", runs, files)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/philippgille/chromem-go"
+)
+
+const (
+	defaultTopK          = 5
+	defaultMinSimilarity = float32(0.3)
+	// defaultContextWindow is used when the chat model does not report its
+	// context length, and maxContextWindow caps what we ask Ollama to allocate
+	defaultContextWindow = 4096
+	maxContextWindow     = 8192
+	// answerReserveTokens are kept free in the context window for the answer
+	answerReserveTokens = 1024
+)
+
+// RetrievalConfig controls how many generated docs are retrieved for a
+// question and how much of them is sent to the chat model. Unset fields fall
+// back to the project, then the global config, then the defaults.
+type RetrievalConfig struct {
+	TopK          int      `json:"top_k,omitempty"`          // Docs to retrieve from the vector DB
+	MinSimilarity *float32 `json:"min_similarity,omitempty"` // Drop docs scoring below this (0 to 1)
+	ContextTokens int      `json:"context_tokens,omitempty"` // Token budget for docs, 0 fills the model's context window
+}
+
+// merge returns r with its unset fields taken from fallback.
+func (r RetrievalConfig) merge(fallback RetrievalConfig) RetrievalConfig {
+	if r.TopK <= 0 {
+		r.TopK = fallback.TopK
+	}
+	if r.MinSimilarity == nil {
+		r.MinSimilarity = fallback.MinSimilarity
+	}
+	if r.ContextTokens <= 0 {
+		r.ContextTokens = fallback.ContextTokens
+	}
+	return r
+}
+
+// retrievalSettings resolves the settings for a question about projectName,
+// with request taking precedence over the project and global config.
+func (ca *CodeAssistant) retrievalSettings(projectName string, request RetrievalConfig) RetrievalConfig {
+	settings := request
+	if projectConfig, err := ca.loadProjectConfig(projectName); err == nil {
+		settings = settings.merge(projectConfig.Retrieval)
+	}
+	return settings.merge(ca.config.Retrieval).merge(RetrievalConfig{TopK: defaultTopK, MinSimilarity: ptr(defaultMinSimilarity)})
+}
+
+// retrievalFromForm reads per-question retrieval overrides from a web form.
+// Missing or invalid values are left unset.
+func retrievalFromForm(r *http.Request) RetrievalConfig {
+	var retrieval RetrievalConfig
+	retrieval.TopK, _ = strconv.Atoi(r.FormValue("top_k"))
+	retrieval.ContextTokens, _ = strconv.Atoi(r.FormValue("context_tokens"))
+	if minSimilarity, err := strconv.ParseFloat(r.FormValue("min_similarity"), 32); err == nil {
+		retrieval.MinSimilarity = ptr(float32(minSimilarity))
+	}
+	return retrieval
+}
+
+// ptr returns a pointer to v, for optional config fields.
+func ptr[T any](v T) *T {
+	return &v
+}
+
+// contextWindows caches the context length reported by the provider per model
+var contextWindows sync.Map
+
+// modelContextWindow returns the context window to run model with: its
+// trained context length, capped at maxContextWindow.
+func modelContextWindow(ctx context.Context, provider ChatProvider, model string) int {
+	if window, ok := contextWindows.Load(model); ok {
+		return window.(int)
+	}
+
+	window := defaultContextWindow
+	length, err := provider.ContextLength(ctx, model)
+	if err != nil {
+		fmt.Printf("Could not read context length of %s, assuming %d tokens: %v\n", model, window, err)
+		return window
+	}
+	if length > 0 {
+		window = min(length, maxContextWindow)
+	}
+	contextWindows.Store(model, window)
+	return window
+}
+
+// packContext selects retrieved chunks for the prompt, best match first,
+// skipping chunks that would overflow the token budget so smaller ones
+// further down can still fit. If not even the best match fits it is truncated
+// rather than dropped. The selected chunks are grouped back by file, in the
+// order of each file's best match, with a header and footer around each file.
+func packContext(results []chromem.Result, budget int) (string, []Source) {
+	type fileChunks struct {
+		path   string
+		best   float32
+		chunks []chromem.Result
+	}
+	var files []*fileChunks
+	byPath := map[string]*fileChunks{}
+
+	for i, result := range results {
+		path := result.Metadata["file_path"]
+		if path == "" {
+			path = result.ID
+		}
+		file := byPath[path]
+		size := estimateTokens(result.Content)
+		if file == nil {
+			// Room for the file's header and footer
+			size += estimateTokens(fileHeader(path, 0) + fileFooter(path))
+		}
+		if size > budget {
+			overhead := size - estimateTokens(result.Content)
+			if i > 0 || budget <= overhead {
+				continue
+			}
+			// About four characters per token, see estimateTokens
+			cut := min(len(result.Content), (budget-overhead)*4)
+			result.Content = strings.ToValidUTF8(result.Content[:cut], "") + "\n[truncated]"
+			size = budget
+		}
+		budget -= size
+
+		if file == nil {
+			file = &fileChunks{path: path, best: result.Similarity}
+			byPath[path] = file
+			files = append(files, file)
+		}
+		file.chunks = append(file.chunks, result)
+	}
+
+	var packed strings.Builder
+	var sources []Source
+	for _, file := range files {
+		slices.SortFunc(file.chunks, func(a, b chromem.Result) int {
+			return metadataInt(a, "chunk_index") - metadataInt(b, "chunk_index")
+		})
+		packed.WriteString(fileHeader(file.path, file.best))
+		lastLine := 0
+		for _, chunk := range file.chunks {
+			startLine, endLine := metadataInt(chunk, "start_line"), metadataInt(chunk, "end_line")
+			content := chunk.Content
+			if startLine > 0 {
+				// Drop lines the previous chunk already showed
+				if lastLine >= startLine {
+					lines := strings.Split(content, "\n")
+					content = strings.Join(lines[min(len(lines), lastLine-startLine+1):], "\n")
+				} else if lastLine > 0 {
+					packed.WriteString("...\n")
+				}
+				lastLine = max(lastLine, endLine)
+			}
+			if content != "" {
+				packed.WriteString(content + "\n")
+			}
+			sources = append(sources, Source{
+				ID:         chunk.ID,
+				FilePath:   chunk.Metadata["file_path"],
+				StartLine:  startLine,
+				EndLine:    endLine,
+				Similarity: chunk.Similarity,
+			})
+		}
+		packed.WriteString(fileFooter(file.path))
+	}
+	return packed.String(), sources
+}
+
+// fileHeader and fileFooter delimit one file's docs in the prompt context.
+func fileHeader(path string, similarity float32) string {
+	return fmt.Sprintf("=== File: %s (similarity %.2f) ===\n", path, similarity)
+}
+
+func fileFooter(path string) string {
+	return fmt.Sprintf("=== End of %s ===\n\n", path)
+}
+
+// metadataInt reads a numeric metadata field of a chunk, 0 when missing.
+func metadataInt(result chromem.Result, key string) int {
+	n, _ := strconv.Atoi(result.Metadata[key])
+	return n
+}
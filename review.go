@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"os"
 	"strconv"
@@ -27,12 +28,7 @@ func (ca *CodeAssistant) reviewCommit(repoPath string) error {
 		return fmt.Errorf("invalid commit selection")
 	}
 
-	diff, err := getGitDiff(repoPath, commits[choice-1])
-	if err != nil {
-		return fmt.Errorf("failed to get diff: %v", err)
-	}
-
-	review, err := ca.generateCodeReview(diff)
+	review, err := ca.reviewCommitHash(ca.ctx, repoPath, commits[choice-1])
 	if err != nil {
 		return err
 	}
@@ -42,7 +38,17 @@ func (ca *CodeAssistant) reviewCommit(repoPath string) error {
 	return nil
 }
 
-func (ca *CodeAssistant) generateCodeReview(diff string) (string, error) {
+// reviewCommitHash generates a review for a single commit of the repository at repoPath.
+func (ca *CodeAssistant) reviewCommitHash(ctx context.Context, repoPath string, commitHash string) (string, error) {
+	diff, err := getGitDiff(repoPath, commitHash)
+	if err != nil {
+		return "", fmt.Errorf("failed to get diff: %v", err)
+	}
+
+	return ca.generateCodeReview(ctx, diff)
+}
+
+func (ca *CodeAssistant) generateCodeReview(ctx context.Context, diff string) (string, error) {
 	prompt := fmt.Sprintf(`Review the following code changes and provide:
 1. Potential bugs or issues
 2. Code style improvements
@@ -55,5 +61,5 @@ Code diff:
 Provide concise, actionable feedback:`, diff)
 
 	// Use existing generateComments infrastructure
-	return ca.generateComments(prompt)
+	return ca.generateComments(ctx, prompt)
 }
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// shutdownTimeout bounds how long in-flight requests get to finish on shutdown
+const shutdownTimeout = 30 * time.Second
+
+// newWebServer builds the HTTP server with all web UI routes registered.
+func (ca *CodeAssistant) newWebServer() *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", ca.homeHandler)
+	mux.HandleFunc("/project/", ca.projectHandler)
+	mux.HandleFunc("/index", ca.indexHandler)
+	mux.HandleFunc("/chat/", ca.chatHandler)
+	mux.HandleFunc("/query", ca.queryHandler)
+	mux.HandleFunc("/reindex", ca.reindexHandler)
+	mux.HandleFunc("/jobs", ca.jobsHandler)
+	mux.HandleFunc("/jobs/", ca.jobHandler)
+	mux.HandleFunc("/login", ca.loginHandler)
+	mux.HandleFunc("/logout", ca.logoutHandler)
+	ca.registerAPIRoutes(mux)
+
+	// Serve static files (CSS, JS, etc.)
+	fs := http.FileServer(http.Dir("static"))
+	mux.Handle("/static/", http.StripPrefix("/static/", fs))
+
+	bindAddress := ca.config.BindAddress
+	if bindAddress == "" {
+		bindAddress = "0.0.0.0"
+	}
+	return &http.Server{
+		Addr:    net.JoinHostPort(bindAddress, ca.config.WebPort),
+		Handler: ca.requireAuth(mux),
+	}
+}
+
+// listenAndServe serves HTTPS when a certificate and key are configured and
+// plain HTTP otherwise.
+func (ca *CodeAssistant) listenAndServe(server *http.Server) error {
+	if !ca.config.Auth.Enabled {
+		host, _, _ := net.SplitHostPort(server.Addr)
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			color.Yellow("⚠️ Authentication is disabled and the web server listens on %s, anyone on the network can use it", host)
+		}
+	}
+
+	if ca.config.TLSCertFile != "" || ca.config.TLSKeyFile != "" {
+		if ca.config.TLSCertFile == "" || ca.config.TLSKeyFile == "" {
+			return fmt.Errorf("both tls_cert_file and tls_key_file must be set to enable TLS")
+		}
+		fmt.Printf("Starting web server on https://%s\n", server.Addr)
+		return server.ListenAndServeTLS(ca.config.TLSCertFile, ca.config.TLSKeyFile)
+	}
+	fmt.Printf("Starting web server on http://%s\n", server.Addr)
+	return server.ListenAndServe()
+}
+
+// StartWebServer starts the web server
+func (ca *CodeAssistant) StartWebServer() {
+	server := ca.newWebServer()
+	log.Fatal(ca.listenAndServe(server))
+}
+
+// renderTemplate executes an HTML template from the templates folder. Templates
+// can call csrfToken to embed the caller's CSRF token in forms and scripts.
+func (ca *CodeAssistant) renderTemplate(w http.ResponseWriter, r *http.Request, file string, data interface{}) {
+	principal, _ := principalFromContext(r.Context())
+	funcs := template.FuncMap{
+		"csrfToken": func() string { return principal.CSRFToken },
+		"username":  func() string { return principal.Username },
+		"llmStatus": ca.llmBreaker.status,
+		"models":    ca.models.list,
+	}
+
+	// Parse the template
+	tmpl, err := template.New(filepath.Base(file)).Funcs(funcs).ParseFiles(file)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error parsing template: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Execute the template
+	err = tmpl.Execute(w, data)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error executing template: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+// Serve runs only the web server until SIGINT or SIGTERM is received, then
+// shuts down gracefully: indexing is checkpointed, in-flight requests are
+// drained and the databases are closed.
+func (ca *CodeAssistant) Serve() error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	server := ca.newWebServer()
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- ca.listenAndServe(server)
+	}()
+
+	select {
+	case err := <-serverErr:
+		ca.Close()
+		return err
+	case <-ctx.Done():
+	}
+	// Restore default signal handling so a second signal exits immediately
+	stop()
+	fmt.Println("\nShutting down, waiting for running work to checkpoint...")
+
+	// Cancel indexing first so handlers blocked on it can return
+	ca.stop()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err := server.Shutdown(shutdownCtx)
+	if closeErr := ca.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("shutdown: %v", err)
+	}
+	fmt.Println("Shutdown complete")
+	return nil
+}
+
+// startIndexing registers an index run that Close waits for, and returns the
+// func that ends it. Once the assistant is shutting down it refuses new runs
+// with ca.ctx's error.
+func (ca *CodeAssistant) startIndexing() (func(), error) {
+	ca.indexingMu.Lock()
+	defer ca.indexingMu.Unlock()
+	if err := ca.ctx.Err(); err != nil {
+		return nil, err
+	}
+	ca.indexing.Add(1)
+	return ca.indexing.Done, nil
+}
+
+// Close stops running indexing at the next file boundary, waits for it to
+// save its progress and closes the SQLite and vector databases. Calls after
+// the first return its result.
+func (ca *CodeAssistant) Close() error {
+	ca.closeOnce.Do(func() {
+		ca.stop()
+		// No run can start once ca.ctx is done, so none is added while waiting
+		ca.indexingMu.Lock()
+		ca.indexingMu.Unlock()
+		ca.indexing.Wait()
+
+		// chromem persists every write immediately, so once indexing has
+		// stopped dropping the handle is enough to release it
+		ca.vectorDB.Store(nil)
+
+		if err := ca.db.Close(); err != nil {
+			ca.closeErr = fmt.Errorf("failed to close SQLite database: %v", err)
+		}
+	})
+	return ca.closeErr
+}
@@ -0,0 +1,54 @@
+// static/job_events.js
+
+// describeJobEvent turns a job event into a single line of text.
+function describeJobEvent(event) {
+    switch (event.type) {
+        case 'file_started':
+            return `Started ${event.file}`;
+        case 'file_documented':
+            return `Documented ${event.file} (${event.done}/${event.total})`;
+        case 'file_failed':
+            return `Failed ${event.file}: ${event.reason}`;
+        case 'cooldown_started':
+            return event.temperature ? `Cooling down at ${event.temperature}°C (${event.source})` : 'Cooling down';
+        case 'cooldown_ended':
+            return event.temperature ? `Resumed at ${event.temperature}°C (${event.source})` : 'Resumed';
+        case 'llm_unavailable':
+            return `Paused, Ollama is unavailable: ${event.reason}`;
+        case 'llm_recovered':
+            return 'Ollama is back, resumed';
+        case 'embedding_progress':
+            return `Embedding documents ${event.done || 0}/${event.total || 0}`;
+        case 'job_finished':
+            return event.reason ? `Job ${event.status}: ${event.reason}` : `Job ${event.status}`;
+        default:
+            return event.type;
+    }
+}
+
+// watchJobEvents streams a job's events into the given list element and
+// calls onFinish with the final event once the job is done.
+function watchJobEvents(jobID, list, onFinish) {
+    const source = new EventSource(`/jobs/${jobID}/events`);
+    const types = ['file_started', 'file_documented', 'file_failed', 'cooldown_started',
+        'cooldown_ended', 'llm_unavailable', 'llm_recovered', 'embedding_progress', 'job_finished'];
+
+    types.forEach((type) => {
+        source.addEventListener(type, (message) => {
+            const event = JSON.parse(message.data);
+            const item = document.createElement('li');
+            item.classList.add('job-event', `job-event-${event.type}`);
+            item.textContent = `${new Date(event.time).toLocaleTimeString()} ${describeJobEvent(event)}`;
+            list.appendChild(item);
+            list.scrollTop = list.scrollHeight;
+
+            if (event.type === 'job_finished') {
+                source.close();
+                if (onFinish) {
+                    onFinish(event);
+                }
+            }
+        });
+    });
+    return source;
+}
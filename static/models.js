@@ -0,0 +1,47 @@
+// static/models.js
+
+// describeModel turns a model status into the text shown after its name, as
+// the home page template renders it.
+function describeModel(model) {
+    let text = model.state;
+    if (model.state === 'pulling') {
+        const percent = model.pull_total ? Math.floor(model.pulled * 100 / model.pull_total) : 0;
+        text += ` ${percent}%`;
+    }
+    if (model.error) {
+        text += `: ${model.error}`;
+    }
+    if (model.context_length) {
+        text += `, context ${model.context_length}`;
+    }
+    return text;
+}
+
+// watchModels polls the model statuses while a model is still being checked
+// or pulled and updates the items of the given list.
+function watchModels(list) {
+    const busy = () => Array.from(list.querySelectorAll('[data-state]'))
+        .some((item) => ['checking', 'missing', 'pulling'].includes(item.dataset.state));
+
+    async function poll() {
+        if (!busy()) {
+            return;
+        }
+        try {
+            const response = await fetch('/api/v1/models');
+            if (response.ok) {
+                (await response.json()).forEach((model) => {
+                    const item = list.querySelector(`[data-model="${CSS.escape(model.name)}"]`);
+                    if (item) {
+                        item.dataset.state = model.state;
+                        item.querySelector('.model-status').textContent = describeModel(model);
+                    }
+                });
+            }
+        } catch (err) {
+            // Try again on the next poll
+        }
+        setTimeout(poll, 2000);
+    }
+    setTimeout(poll, 2000);
+}
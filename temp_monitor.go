@@ -118,7 +118,7 @@ func (tm *TemperatureMonitor) CoolDown() error {
 			source = "cpu"
 		}
 
-		tempMsg := fmt.Sprintf("%.1f°C", temp)
+		tempMsg := fmt.Sprintf("%d°C", temp)
 		if temp >= tm.criticalTemp {
 			tempMsg = tempDanger(tempMsg)
 		} else if temp >= tm.safeTemp {
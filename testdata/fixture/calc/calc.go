@@ -0,0 +1,20 @@
+// Package calc does arithmetic for the reporting service.
+package calc
+
+import "errors"
+
+// ErrDivideByZero is returned when dividing by zero.
+var ErrDivideByZero = errors.New("divide by zero")
+
+// Add returns the sum of a and b.
+func Add(a, b int) int {
+	return a + b
+}
+
+// Divide returns a divided by b.
+func Divide(a, b int) (int, error) {
+	if b == 0 {
+		return 0, ErrDivideByZero
+	}
+	return a / b, nil
+}
@@ -0,0 +1,14 @@
+"""Renders the monthly usage report."""
+
+
+def render_report(rows):
+    """Formats usage rows as a plain text table."""
+    return "\n".join(f"{name}\t{count}" for name, count in rows)
+
+
+def monthly_totals(rows):
+    """Sums the usage counts per customer."""
+    totals = {}
+    for name, count in rows:
+        totals[name] = totals.get(name, 0) + count
+    return totals
@@ -0,0 +1,26 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+)
+
+// HashPassword hashes a password before it is compared with the stored one.
+func HashPassword(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+// HandleLogin checks the submitted credentials and starts a session.
+func HandleLogin(w http.ResponseWriter, r *http.Request) {
+	if HashPassword(r.FormValue("password")) != storedHash(r.FormValue("user")) {
+		http.Error(w, "invalid credentials", http.StatusUnauthorized)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: "session", Value: newSessionID()})
+}
+
+func storedHash(user string) string { return "" }
+
+func newSessionID() string { return "" }
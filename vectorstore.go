@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/philippgille/chromem-go"
+	"github.com/schollz/progressbar/v3"
+)
+
+// errVectorDBClosed is returned once the assistant has been closed
+var errVectorDBClosed = errors.New("vector DB is closed")
+
+// vectorStore returns the current vector DB handle.
+func (ca *CodeAssistant) vectorStore() (*chromem.DB, error) {
+	db := ca.vectorDB.Load()
+	if db == nil {
+		return nil, errVectorDBClosed
+	}
+	return db, nil
+}
+
+// embedFileDocs reads the generated doc of each file and embeds its chunks,
+// reusing the chunks already in embedded. Files whose doc no longer exists
+// yield no chunks. Chunks are embedded in batches by the indexing workers,
+// sharing the LLM request slots with index runs.
+func (ca *CodeAssistant) embedFileDocs(ctx context.Context, job *Job, projectName, codebasePath string, relPaths []string, embedded map[string][]chromem.Document) ([]chromem.Document, error) {
+	projectDocsDir := filepath.Join(ca.config.DocsDir, projectName)
+
+	var documents, chunks []chromem.Document
+	for _, relPath := range relPaths {
+		if docs, ok := embedded[relPath]; ok {
+			documents = append(documents, docs...)
+			continue
+		}
+		content, err := ioutil.ReadFile(filepath.Join(projectDocsDir, relPath+".txt"))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, chunkDocuments(relPath, filepath.Join(codebasePath, relPath), string(content))...)
+	}
+
+	if len(chunks) == 0 {
+		return documents, nil
+	}
+	bar := progressbar.Default(int64(len(chunks)), "Embedding chunks")
+	job.embeddingProgress(0, len(chunks))
+	var (
+		mu       sync.Mutex
+		done     int
+		firstErr error
+		workers  sync.WaitGroup
+	)
+	next := make(chan []chromem.Document)
+	for w := 0; w < ca.config.Indexing.withDefaults().Workers; w++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for batch := range next {
+				err := ca.embedDocuments(ctx, batch)
+				mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				done += len(batch)
+				bar.Add(len(batch))
+				job.embeddingProgress(done, len(chunks))
+				mu.Unlock()
+			}
+		}()
+	}
+	for start := 0; start < len(chunks); start += embedBatchSize {
+		mu.Lock()
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed {
+			break
+		}
+		next <- chunks[start:min(start+embedBatchSize, len(chunks))]
+	}
+	close(next)
+	workers.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return append(documents, chunks...), nil
+}
+
+// projectCollection returns the project's current collection, or nil if it
+// has none.
+func (ca *CodeAssistant) projectCollection(vectorDB *chromem.DB, projectName string) (*chromem.Collection, error) {
+	name, err := ca.collectionName(projectName)
+	if err != nil {
+		return nil, err
+	}
+	return vectorDB.GetCollection(name, ca.embeddingFunc()), nil
+}
+
+// ownsCollection reports whether a collection belongs to the project. Rebuilt
+// collections are named after the project with a suffix after a slash, which
+// project names cannot contain.
+func ownsCollection(projectName, collection string) bool {
+	return collection == projectName || strings.HasPrefix(collection, projectName+"/")
+}
+
+// createVectorStore embeds all generated docs of a project into a fresh
+// collection. Other projects' collections are not touched. The new
+// collection is built under a name of its own and swapped in once complete,
+// so the old one keeps answering queries until then and is kept if the
+// rebuild fails.
+func (ca *CodeAssistant) createVectorStore(ctx context.Context, job *Job, projectName, codebasePath string, embedded map[string][]chromem.Document) error {
+	projectDocsDir := filepath.Join(ca.config.DocsDir, projectName)
+
+	var relPaths []string
+	err := filepath.Walk(projectDocsDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && strings.HasSuffix(path, ".txt") {
+			relPaths = append(relPaths, strings.TrimSuffix(strings.TrimPrefix(path, projectDocsDir+string(filepath.Separator)), ".txt"))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	documents, err := ca.embedFileDocs(ctx, job, projectName, codebasePath, relPaths, embedded)
+	if err != nil {
+		return err
+	}
+
+	vectorDB, err := ca.vectorStore()
+	if err != nil {
+		return err
+	}
+	oldName, err := ca.collectionName(projectName)
+	if err != nil {
+		return err
+	}
+	// Drop collections left behind by rebuilds that were interrupted
+	for name := range vectorDB.ListCollections() {
+		if name != oldName && ownsCollection(projectName, name) {
+			if err := vectorDB.DeleteCollection(name); err != nil {
+				return fmt.Errorf("failed to delete stale vector collection: %v", err)
+			}
+		}
+	}
+
+	dimension := 0
+	if len(documents) > 0 {
+		dimension = len(documents[0].Embedding)
+	}
+	name := fmt.Sprintf("%s/%d", projectName, time.Now().UnixNano())
+	metadata := map[string]string{"embedding_model": ca.config.EmbeddingModel, "embedding_dimension": strconv.Itoa(dimension)}
+	collec, err := vectorDB.CreateCollection(name, metadata, ca.embeddingFunc())
+	if err != nil {
+		return fmt.Errorf("failed to create vector collection: %v", err)
+	}
+	if len(documents) > 0 {
+		err := collec.AddDocuments(ctx, documents, 1)
+		if err == nil {
+			// chromem skips the remaining documents without an error once ctx is done
+			err = ctx.Err()
+		}
+		if err != nil {
+			vectorDB.DeleteCollection(name)
+			return fmt.Errorf("failed to add documents to vector DB: %v", err)
+		}
+	}
+
+	lock := ca.registry.vectorLock(projectName)
+	lock.Lock()
+	defer lock.Unlock()
+	if err := ca.recordCollection(projectName, name, dimension); err != nil {
+		vectorDB.DeleteCollection(name)
+		return err
+	}
+	if err := vectorDB.DeleteCollection(oldName); err != nil {
+		return fmt.Errorf("failed to delete old vector collection: %v", err)
+	}
+	fmt.Printf("Index created for %s with %d chunks of %s embeddings\n", projectName, len(documents), ca.config.EmbeddingModel)
+	return nil
+}
+
+// updateVectorStore replaces the chunks of the given files in the project's
+// collection with their current docs, and removes the chunks of files whose
+// docs were deleted. The new chunks are embedded first and swapped in under
+// the write lock, so queries never see a file half updated.
+func (ca *CodeAssistant) updateVectorStore(ctx context.Context, job *Job, projectName, codebasePath string, relPaths []string, embedded map[string][]chromem.Document) error {
+	documents, err := ca.embedFileDocs(ctx, job, projectName, codebasePath, relPaths, embedded)
+	if err != nil {
+		return err
+	}
+
+	vectorDB, err := ca.vectorStore()
+	if err != nil {
+		return err
+	}
+	lock := ca.registry.vectorLock(projectName)
+	lock.Lock()
+	defer lock.Unlock()
+	name, err := ca.collectionName(projectName)
+	if err != nil {
+		return err
+	}
+	collec := vectorDB.GetCollection(name, ca.embeddingFunc())
+	if collec == nil {
+		return fmt.Errorf("project %s has no vector collection", projectName)
+	}
+	if len(documents) > 0 {
+		// Vectors of another dimension cannot be compared with the collection's
+		_, dimension, found, err := ca.collectionInfo(projectName)
+		if err != nil {
+			return err
+		}
+		if found && dimension > 0 && dimension != len(documents[0].Embedding) {
+			return fmt.Errorf("project %s has %d-dimensional embeddings, not %d, reindex it with --wipe", projectName, dimension, len(documents[0].Embedding))
+		}
+		if !found || dimension == 0 {
+			if err := ca.recordCollection(projectName, name, len(documents[0].Embedding)); err != nil {
+				return err
+			}
+		}
+	}
+	for _, relPath := range relPaths {
+		if err := collec.Delete(ctx, map[string]string{"rel_path": relPath}, nil); err != nil {
+			return fmt.Errorf("failed to delete chunks of %s: %v", relPath, err)
+		}
+		// Collections built before chunking hold one document per file
+		if err := collec.Delete(ctx, nil, nil, relPath); err != nil {
+			return fmt.Errorf("failed to delete document %s: %v", relPath, err)
+		}
+	}
+	if len(documents) > 0 {
+		if err := collec.AddDocuments(ctx, documents, 1); err != nil {
+			return fmt.Errorf("failed to add documents to vector DB: %v", err)
+		}
+	}
+	fmt.Printf("Index updated for %s: %d files, %d chunks\n", projectName, len(relPaths), len(documents))
+	return nil
+}
+
+// deleteVectorCollection drops a project's collections, including any left
+// behind by an interrupted rebuild.
+func (ca *CodeAssistant) deleteVectorCollection(projectName string) error {
+	vectorDB, err := ca.vectorStore()
+	if err != nil {
+		return err
+	}
+	lock := ca.registry.vectorLock(projectName)
+	lock.Lock()
+	defer lock.Unlock()
+	for name := range vectorDB.ListCollections() {
+		if ownsCollection(projectName, name) {
+			if err := vectorDB.DeleteCollection(name); err != nil {
+				return err
+			}
+		}
+	}
+	_, err = ca.db.Exec("DELETE FROM vector_collections WHERE project = ?", projectName)
+	return err
+}
+
+// syncVectorStore brings the project's collection up to date with the docs
+// written since it was last embedded. Only the pending files are re-embedded,
+// unless the collection does not exist yet, was flagged for a full rebuild or
+// was built with another embedding model.
+// Chunks the index run already embedded are taken from embedded. The caller
+// must hold the project's index lock.
+func (ca *CodeAssistant) syncVectorStore(ctx context.Context, job *Job, project *ProjectConfig, codebasePath string, embedded map[string][]chromem.Document) error {
+	vectorDB, err := ca.vectorStore()
+	if err != nil {
+		return err
+	}
+	projectName := project.ProjectName
+	modelChanged, err := ca.embeddingModelChanged(projectName)
+	if err != nil {
+		return err
+	}
+	collec, err := ca.projectCollection(vectorDB, projectName)
+	if err != nil {
+		return err
+	}
+	switch {
+	case collec == nil || project.PendingEmbedding || modelChanged:
+		if err := ca.createVectorStore(ctx, job, projectName, codebasePath, embedded); err != nil {
+			return err
+		}
+	case len(project.PendingFiles) > 0:
+		if err := ca.updateVectorStore(ctx, job, projectName, codebasePath, project.PendingFiles, embedded); err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+
+	project.PendingEmbedding = false
+	project.PendingFiles = nil
+	return ca.updateProject(projectName, func(config *ProjectConfig) {
+		config.PendingEmbedding = false
+		config.PendingFiles = nil
+	})
+}
+
+// embedBatchFiles is how many newly documented files an index run collects
+// before adding them to the vector store.
+const embedBatchFiles = 10
+
+// flushEmbedded adds the docs an index run has embedded so far to the
+// project's collection and records them in the run's journal, so they can be
+// searched before the run ends. It does nothing while the collection waits
+// for a full rebuild.
+func (ca *CodeAssistant) flushEmbedded(ctx context.Context, job *Job, project *ProjectConfig, codebasePath string, runID int64, embedded map[string][]chromem.Document) error {
+	if len(embedded) == 0 || project.PendingEmbedding {
+		return nil
+	}
+	vectorDB, err := ca.vectorStore()
+	if err != nil {
+		return err
+	}
+
+	modelChanged, err := ca.embeddingModelChanged(project.ProjectName)
+	if err != nil {
+		return err
+	}
+	collec, err := ca.projectCollection(vectorDB, project.ProjectName)
+	if err != nil {
+		return err
+	}
+	relPaths := slices.Sorted(maps.Keys(embedded))
+	if collec == nil || modelChanged {
+		// The first batch builds the collection from every doc on disk
+		if err := ca.createVectorStore(ctx, job, project.ProjectName, codebasePath, embedded); err != nil {
+			return err
+		}
+		project.PendingFiles = nil
+		err = ca.markRunEmbedded(runID)
+	} else {
+		if err := ca.updateVectorStore(ctx, job, project.ProjectName, codebasePath, relPaths, embedded); err != nil {
+			return err
+		}
+		project.PendingFiles = slices.DeleteFunc(project.PendingFiles, func(relPath string) bool {
+			_, ok := embedded[relPath]
+			return ok
+		})
+		err = ca.markFilesEmbedded(runID, relPaths)
+	}
+	clear(embedded)
+	return err
+}
+
+// addPendingFile records that a file's doc changed and must be re-embedded.
+func addPendingFile(pending []string, relPath string) []string {
+	if slices.Contains(pending, relPath) {
+		return pending
+	}
+	return append(pending, relPath)
+}
+
+// queryVectorStore returns up to n chunks of the project's docs closest to
+// text. The question is embedded before taking the read lock, which is only
+// held for the lookup so indexing is not blocked while answers are generated.
+func (ca *CodeAssistant) queryVectorStore(ctx context.Context, projectName, text string, n int) ([]chromem.Result, error) {
+	vectorDB, err := ca.vectorStore()
+	if err != nil {
+		return nil, err
+	}
+	model, _, found, err := ca.collectionInfo(projectName)
+	if err != nil {
+		return nil, err
+	}
+	if found && model != ca.config.EmbeddingModel {
+		return nil, fmt.Errorf("project %s was indexed with embedding model %s, reindex it to search with %s", projectName, model, ca.config.EmbeddingModel)
+	}
+	embedding, err := ca.embeddingFunc()(ctx, text)
+	if err != nil {
+		return nil, fmt.Errorf("failed to embed question: %w", err)
+	}
+
+	lock := ca.registry.vectorLock(projectName)
+	lock.RLock()
+	defer lock.RUnlock()
+	collec, err := ca.projectCollection(vectorDB, projectName)
+	if err != nil {
+		return nil, err
+	}
+	if collec == nil {
+		return nil, fmt.Errorf("project %s has not been indexed", projectName)
+	}
+	// chromem refuses to return more results than the collection holds
+	if n = min(n, collec.Count()); n == 0 {
+		return nil, nil
+	}
+	results, err := collec.QueryEmbedding(ctx, embedding, n, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search vector DB: %v", err)
+	}
+	return results, nil
+}